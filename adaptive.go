@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"yoursync/bitio"
+)
+
+// Huffman adaptativo (FLAG_ADAPTIVE), pelo algoritmo FGK. Codificador e
+// decodificador começam com a árvore vazia e a atualizam depois de cada
+// símbolo, então não há passada de contagem nem árvore no arquivo: cada
+// símbolo pode ir para a saída assim que o LZ77 o produz. Símbolos que ainda
+// não apareceram saem como o código do nó NYT ("ainda não transmitido")
+// seguido do índice cru.
+//
+// Como nos streams estáticos, literais/comprimentos e distâncias têm árvores
+// separadas. O stream não tem tamanho na frente: termina no EOF (256).
+const (
+	// Marca de flush do StreamWriter (stream.go): o resto do byte é
+	// preenchimento e tudo antes dela já pode ser decodificado
+	adaptiveFlush = 286
+
+	adaptiveLitSymbols  = 287 // 0-255, EOF, comprimentos e a marca de flush
+	adaptiveLitBits     = 9
+	adaptiveDistSymbols = 32
+	adaptiveDistBits    = 5
+)
+
+// Os nós ficam num array em ordem de peso (a propriedade dos irmãos):
+// irmãos ocupam posições vizinhas, a raiz é a última posição e os nós em uso
+// vão de nyt até ela. Trocar dois nós troca o conteúdo das posições; o pai é
+// da posição e não muda.
+type adaptiveTree struct {
+	weight []int
+	parent []int
+	child  []int // Filho direito (o esquerdo é child-1); -1 nas folhas
+	symbol []int // Símbolo das folhas; -1 no NYT e nos nós internos
+	leaf   []int // Posição da folha de cada símbolo; -1 se ainda não apareceu
+	nyt    int
+	offset int   // Código do símbolo 0 (300 nas distâncias)
+	bits   uint8 // Bits do índice cru depois do NYT
+	path   []byte
+}
+
+func newAdaptiveTree(symbols, offset int, bits uint8) *adaptiveTree {
+	n := 2*symbols + 1
+	t := &adaptiveTree{
+		weight: make([]int, n),
+		parent: make([]int, n),
+		child:  make([]int, n),
+		symbol: make([]int, n),
+		leaf:   make([]int, symbols),
+		offset: offset,
+		bits:   bits,
+	}
+	t.reset()
+	return t
+}
+
+// Volta à árvore só com o NYT
+func (t *adaptiveTree) reset() {
+	root := len(t.weight) - 1
+	for i := range t.leaf {
+		t.leaf[i] = -1
+	}
+	t.nyt = root
+	t.weight[root], t.parent[root], t.child[root], t.symbol[root] = 0, -1, -1, -1
+}
+
+func (t *adaptiveTree) root() int { return len(t.weight) - 1 }
+
+func (t *adaptiveTree) write(bw *bitio.Writer, code int) {
+	s := code - t.offset
+	if pos := t.leaf[s]; pos >= 0 {
+		t.writePath(bw, pos)
+	} else {
+		t.writePath(bw, t.nyt)
+		bw.WriteBits(uint64(s), t.bits)
+	}
+	t.update(s)
+}
+
+// Código de um nó: o caminho da raiz até ele (1 = filho direito)
+func (t *adaptiveTree) writePath(bw *bitio.Writer, pos int) {
+	t.path = t.path[:0]
+	for pos != t.root() {
+		p := t.parent[pos]
+		t.path = append(t.path, byte(pos-t.child[p]+1))
+		pos = p
+	}
+	for i := len(t.path) - 1; i >= 0; i-- {
+		bw.WriteBits(uint64(t.path[i]), 1)
+	}
+}
+
+func (t *adaptiveTree) read(br *bitio.Reader) (int, error) {
+	pos := t.root()
+	for t.child[pos] >= 0 {
+		bit, err := br.ReadBits(1)
+		if err != nil {
+			return 0, err
+		}
+		pos = t.child[pos] - 1 + int(bit)
+	}
+
+	s := t.symbol[pos]
+	if pos == t.nyt {
+		raw, err := br.ReadBits(t.bits)
+		if err != nil {
+			return 0, err
+		}
+		s = int(raw)
+		if s >= len(t.leaf) || t.leaf[s] >= 0 {
+			return 0, fmt.Errorf("símbolo novo inválido: %d", s+t.offset)
+		}
+	}
+	t.update(s)
+	return s + t.offset, nil
+}
+
+// Conta mais uma ocorrência de s. Um símbolo novo nasce do NYT, que vira um
+// nó interno com o novo NYT e a folha de s como filhos. Depois, do nó até a
+// raiz: troca cada nó com o líder do seu bloco (a maior posição com o mesmo
+// peso, se não for o pai) e soma 1 ao peso.
+func (t *adaptiveTree) update(s int) {
+	pos := t.leaf[s]
+	if pos < 0 {
+		old := t.nyt
+		pos, t.nyt = old-1, old-2
+		t.child[old] = pos
+		for _, n := range [2]int{pos, t.nyt} {
+			t.weight[n], t.parent[n], t.child[n], t.symbol[n] = 0, old, -1, -1
+		}
+		t.symbol[pos] = s
+		t.leaf[s] = pos
+	}
+
+	root := t.root()
+	for {
+		leader := pos
+		for leader < root && t.weight[leader+1] == t.weight[pos] {
+			leader++
+		}
+		if leader != pos && leader != t.parent[pos] {
+			t.swap(pos, leader)
+			pos = leader
+		}
+		t.weight[pos]++
+		if pos == root {
+			return
+		}
+		pos = t.parent[pos]
+	}
+}
+
+func (t *adaptiveTree) swap(a, b int) {
+	t.child[a], t.child[b] = t.child[b], t.child[a]
+	t.symbol[a], t.symbol[b] = t.symbol[b], t.symbol[a]
+	for _, n := range [2]int{a, b} {
+		if c := t.child[n]; c >= 0 {
+			t.parent[c], t.parent[c-1] = n, n
+		} else if s := t.symbol[n]; s >= 0 {
+			t.leaf[s] = n
+		}
+	}
+}
+
+// As duas árvores de um stream adaptativo
+type adaptiveCoder struct {
+	lit, dist *adaptiveTree
+	inDist    bool // O último símbolo foi um comprimento
+}
+
+func newAdaptiveCoder() *adaptiveCoder {
+	return &adaptiveCoder{
+		lit:  newAdaptiveTree(adaptiveLitSymbols, 0, adaptiveLitBits),
+		dist: newAdaptiveTree(adaptiveDistSymbols, 300, adaptiveDistBits),
+	}
+}
+
+func (c *adaptiveCoder) writeSymbol(bw *bitio.Writer, s LZ77Symbol) {
+	code := s.Code()
+	if isDistanceCode(code) {
+		c.dist.write(bw, code)
+	} else {
+		c.lit.write(bw, code)
+	}
+	if eb := s.ExtraBits(); eb > 0 {
+		bw.WriteBits(uint64(s.ExtraVal()), uint8(eb))
+	}
+}
+
+// Grava a marca de flush e completa o byte
+func (c *adaptiveCoder) writeFlush(bw *bitio.Writer) error {
+	c.lit.write(bw, adaptiveFlush)
+	return bw.Align()
+}
+
+// Próximo código do stream, com os bits extras já lidos
+func (c *adaptiveCoder) readSymbol(br *bitio.Reader) (LZ77Symbol, error) {
+	tree := c.lit
+	if c.inDist {
+		tree = c.dist
+	}
+	code, err := tree.read(br)
+	if err != nil {
+		return 0, err
+	}
+	c.inDist = isLengthCode(code)
+	if code == adaptiveFlush {
+		br.ByteAlign()
+	}
+	return readExtraBits(br, code)
+}
+
+// Aplica um símbolo sobre dst (que precisa ter o histórico das distâncias)
+// e devolve o código lido, para o chamador reconhecer o EOF e a marca de
+// flush
+func (c *adaptiveCoder) decodeStep(br *bitio.Reader, dst []byte) (out []byte, code int, err error) {
+	s, err := c.readSymbol(br)
+	if err != nil {
+		return dst, 0, err
+	}
+	code = s.Code()
+	switch {
+	case code < 256:
+		dst = append(dst, byte(code))
+	case isLengthCode(code):
+		baseLen, _ := GetLengthBase(code)
+		d, err := c.readSymbol(br)
+		if err != nil {
+			return dst, code, err
+		}
+		baseDist, _ := GetDistanceBase(d.Code())
+		dist := baseDist + d.ExtraVal()
+		if dist > len(dst) {
+			return dst, code, fmt.Errorf("distância inválida: %d na pos %d", dist, len(dst))
+		}
+		for range baseLen + s.ExtraVal() {
+			dst = append(dst, dst[len(dst)-dist])
+		}
+	}
+	return dst, code, nil
+}
+
+func AdaptiveCompress(data []byte, output io.Writer, isImage bool) error {
+	return AdaptiveCompressLevel(data, output, isImage, 0)
+}
+
+// Stream adaptativo de um buffer inteiro: [códigos][EOF], sem tamanho
+func AdaptiveCompressLevel(data []byte, output io.Writer, isImage bool, level int) error {
+	symbols := LZ77CompressLevel(data, isImage, level)
+	fmt.Printf("[Compress] Símbolos LZ77 gerados: %d\n", len(symbols))
+
+	bw := bitio.NewWriter(output)
+	coder := newAdaptiveCoder()
+	for _, s := range symbols {
+		coder.writeSymbol(bw, s)
+	}
+	return bw.Flush()
+}
+
+// Como o HuffmanDecompressPrefix: para depois de `limit` bytes (limit < 0
+// decodifica até o EOF)
+func AdaptiveDecompressPrefix(r io.Reader, limit int) ([]byte, error) {
+	br := bitio.NewReader(r)
+	coder := newAdaptiveCoder()
+
+	var result []byte
+	for limit < 0 || len(result) < limit {
+		var code int
+		var err error
+		result, code, err = coder.decodeStep(br, result)
+		if err != nil {
+			return nil, fmt.Errorf("stream adaptativo na pos %d: %w", len(result), err)
+		}
+		if code == 256 {
+			break
+		}
+	}
+	if limit >= 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	fmt.Printf("[Decompress] Sucesso! Total: %d bytes\n", len(result))
+	return result, nil
+}
+
+// Decodifica um stream adaptativo aos poucos, devolvendo os bytes assim que
+// o codificador dá flush. Guarda só a janela do LZ77 do que já foi lido.
+type AdaptiveReader struct {
+	br     *bitio.Reader
+	coder  *adaptiveCoder
+	window []byte // Histórico das distâncias + bytes ainda não devolvidos
+	out    int    // Início dos bytes não devolvidos em window
+	done   bool
+	err    error
+}
+
+// r precisa estar no começo do stream, logo depois do cabeçalho
+func NewAdaptiveReader(r io.Reader) *AdaptiveReader {
+	return &AdaptiveReader{br: bitio.NewReader(r), coder: newAdaptiveCoder()}
+}
+
+func (ar *AdaptiveReader) Read(p []byte) (int, error) {
+	// Decodifica até ter o suficiente para p ou chegar a um flush: depois
+	// dele o próximo símbolo pode ainda não ter sido escrito
+	for len(ar.window)-ar.out < len(p) && !ar.done && ar.err == nil {
+		var code int
+		ar.window, code, ar.err = ar.coder.decodeStep(ar.br, ar.window)
+		if code == 256 {
+			ar.done = true
+		}
+		if code == adaptiveFlush && len(ar.window) > ar.out {
+			break
+		}
+	}
+
+	n := copy(p, ar.window[ar.out:])
+	ar.out += n
+	if ar.out > 2*lz77WindowSize {
+		drop := ar.out - lz77WindowSize
+		ar.window = ar.window[:copy(ar.window, ar.window[drop:])]
+		ar.out -= drop
+	}
+
+	if n > 0 {
+		return n, nil
+	}
+	if ar.err != nil {
+		if ar.err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("stream adaptativo truncado")
+		}
+		return 0, ar.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Filtro adaptativo por linha, no estilo do PNG. Cada linha é gravada como
+// [preditor u8][resíduos], com o preditor escolhido pela menor soma dos
+// resíduos em valor absoluto (interpretados como int8). Screenshots costumam
+// preferir Sub/Up (áreas chapadas); fotos preferem Paeth ou MED.
+//
+// a = pixel à esquerda, b = acima, c = acima à esquerda (mesmo canal)
+const (
+	PRED_NONE    = 0
+	PRED_SUB     = 1 // a
+	PRED_UP      = 2 // b
+	PRED_AVERAGE = 3 // (a+b)/2, o preditor fixo original
+	PRED_PAETH   = 4
+	PRED_MED     = 5 // Median Edge Detector do LOCO-I / JPEG-LS
+
+	numPredictors = 6
+)
+
+func predict(pred uint8, a, b, c byte) byte {
+	switch pred {
+	case PRED_SUB:
+		return a
+	case PRED_UP:
+		return b
+	case PRED_AVERAGE:
+		return byte((int(a) + int(b)) / 2)
+	case PRED_PAETH:
+		return paeth(a, b, c)
+	case PRED_MED:
+		return med(a, b, c)
+	}
+	return 0
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func med(a, b, c byte) byte {
+	mn, mx := min(a, b), max(a, b)
+	if c >= mx {
+		return mn
+	}
+	if c <= mn {
+		return mx
+	}
+	return byte(int(a) + int(b) - int(c))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Vizinhos (a, b, c) da amostra x da linha y
+func neighbours(data []byte, rowSize, channels, y, x int) (a, b, c byte) {
+	idx := y*rowSize + x
+	if x >= channels {
+		a = data[idx-channels]
+	}
+	if y > 0 {
+		b = data[idx-rowSize]
+		if x >= channels {
+			c = data[idx-rowSize-channels]
+		}
+	}
+	return
+}
+
+// Saída: height linhas de (1 + width*channels) bytes
+func ApplyAdaptiveFilter(data []byte, width int, channels int) []byte {
+	rowSize := width * channels
+	height := len(data) / rowSize
+	filtered := make([]byte, height*(rowSize+1))
+
+	// As linhas só dependem da imagem original, então dá para paralelizar
+	numCPU := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	chunkSize := height / numCPU
+
+	for i := range numCPU {
+		wg.Add(1)
+		sY := i * chunkSize
+		eY := (i + 1) * chunkSize
+		if i == numCPU-1 {
+			eY = height
+		}
+
+		go func(startY, endY int) {
+			defer wg.Done()
+			for y := startY; y < endY; y++ {
+				out := filtered[y*(rowSize+1) : (y+1)*(rowSize+1)]
+				out[0] = filterRow(data, out[1:], rowSize, channels, y)
+			}
+		}(sY, eY)
+	}
+
+	wg.Wait()
+	return filtered
+}
+
+// Testa todos os preditores na linha y e deixa em out os resíduos do melhor
+func filterRow(data, out []byte, rowSize, channels, y int) uint8 {
+	bestPred, bestCost := uint8(0), -1
+	for pred := uint8(0); pred < numPredictors; pred++ {
+		cost := 0
+		for x := range rowSize {
+			a, b, c := neighbours(data, rowSize, channels, y, x)
+			residual := int8(data[y*rowSize+x] - predict(pred, a, b, c))
+			cost += abs(int(residual))
+		}
+		if bestCost < 0 || cost < bestCost {
+			bestPred, bestCost = pred, cost
+		}
+	}
+
+	for x := range rowSize {
+		a, b, c := neighbours(data, rowSize, channels, y, x)
+		out[x] = data[y*rowSize+x] - predict(bestPred, a, b, c)
+	}
+	return bestPred
+}
+
+func RemoveAdaptiveFilter(filtered []byte, width int, channels int) ([]byte, error) {
+	rowSize := width * channels
+	if len(filtered)%(rowSize+1) != 0 {
+		return nil, fmt.Errorf("filtro adaptativo: %d bytes não formam linhas de %d", len(filtered), rowSize+1)
+	}
+	height := len(filtered) / (rowSize + 1)
+	restored := make([]byte, height*rowSize)
+
+	for y := range height {
+		in := filtered[y*(rowSize+1) : (y+1)*(rowSize+1)]
+		pred := in[0]
+		if pred >= numPredictors {
+			return nil, fmt.Errorf("preditor desconhecido %d na linha %d", pred, y)
+		}
+		for x := range rowSize {
+			a, b, c := neighbours(restored, rowSize, channels, y, x)
+			restored[y*rowSize+x] = in[1+x] + predict(pred, a, b, c)
+		}
+	}
+	return restored, nil
+}
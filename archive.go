@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layout do arquivo multi-entrada (.ysa):
+//
+//	[magic "YSA2"]
+//	[payload .ys da entrada 0][payload .ys da entrada 1]...
+//	[diretório central: uma entrada serializada por arquivo]
+//	[trailer: offset do diretório (uint64) | nº de entradas (uint32) | magic "YSAD"]
+//
+// O diretório fica no fim para que o pack grave tudo numa única passada, e o
+// trailer de tamanho fixo permite achar o diretório sem tocar nos payloads.
+//
+// No modo sólido, entradas consecutivas de texto são concatenadas num único
+// payload .ys (mesma janela LZ77 e mesma árvore de Huffman). Todas as entradas
+// do grupo apontam para esse payload e guardam em SolidOffset onde começam
+// dentro dos dados descomprimidos do grupo. O grupo recomeça na primeira
+// fronteira de entrada depois de SOLID_GROUP_LIMIT: cada grupo é um ponto de
+// reinício decodificável sozinho, e o Offset no diretório diz qual é.
+const (
+	ARCHIVE_MAGIC    = "YSA2"
+	ARCHIVE_MAGIC_V1 = "YSA1" // Sem modo sólido
+	ARCHIVE_TRAILER  = "YSAD"
+
+	archiveTrailerSize = 8 + 4 + 4
+
+	ENTRY_FLAG_SOLID = 1 << 0
+
+	// Grupos sólidos são fechados ao passar deste tamanho descomprimido, o
+	// que limita quanto um extract precisa decodificar para chegar na
+	// entrada: no máximo isso mais a própria entrada. Os matches só alcançam
+	// lz77WindowSize para trás, então grupos maiores quase não comprimem
+	// melhor (0,3% num pacote de logs e fontes de 4,7 MB, contra 64 MiB).
+	SOLID_GROUP_LIMIT = 1 << 20
+)
+
+// Uma entrada do diretório central
+type ArchiveEntry struct {
+	Name           string // Caminho relativo, sempre com '/'
+	Size           uint64 // Tamanho original dos dados
+	CompressedSize uint64 // Tamanho do payload .ys
+	Offset         uint64 // Posição do payload dentro do arquivo
+	ModTime        time.Time
+	Mode           fs.FileMode
+	DataType       uint8
+	Flags          uint8
+	SolidOffset    uint64 // Início da entrada dentro do grupo sólido
+}
+
+func (e *ArchiveEntry) IsSolid() bool {
+	return e.Flags&ENTRY_FLAG_SOLID != 0
+}
+
+type ArchiveWriter struct {
+	w       io.Writer
+	offset  uint64
+	entries []ArchiveEntry
+
+	solid        bool
+	solidData    bytes.Buffer   // Dados concatenados do grupo em aberto
+	solidPending []ArchiveEntry // Entradas do grupo, ainda sem Offset
+}
+
+func NewArchiveWriter(w io.Writer, solid bool) (*ArchiveWriter, error) {
+	if _, err := io.WriteString(w, ARCHIVE_MAGIC); err != nil {
+		return nil, err
+	}
+	return &ArchiveWriter{w: w, offset: uint64(len(ARCHIVE_MAGIC)), solid: solid}, nil
+}
+
+// Registra uma entrada. No modo sólido, texto vai para o grupo em aberto;
+// imagens (e tudo no modo normal) viram um payload .ys independente. O
+// tamanho listado é o do arquivo em info; fora das imagens, data tem que ser
+// o conteúdo inteiro dele.
+func (aw *ArchiveWriter) AddFile(name string, data []byte, dataType uint8, width int, info fs.FileInfo) error {
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		return err
+	}
+	if !kind.IsImage && int64(len(data)) != info.Size() {
+		return fmt.Errorf("%s: %d bytes lidos, o arquivo tem %d (mudou durante o pack?)", name, len(data), info.Size())
+	}
+
+	if aw.solid && !kind.IsImage {
+		aw.solidPending = append(aw.solidPending, ArchiveEntry{
+			Name:        filepath.ToSlash(name),
+			Size:        uint64(info.Size()),
+			ModTime:     info.ModTime(),
+			Mode:        info.Mode().Perm(),
+			DataType:    dataType,
+			Flags:       ENTRY_FLAG_SOLID,
+			SolidOffset: uint64(aw.solidData.Len()),
+		})
+		aw.solidData.Write(data)
+
+		if aw.solidData.Len() >= SOLID_GROUP_LIMIT {
+			return aw.flushSolid()
+		}
+		return nil
+	}
+
+	// Mantém a ordem das entradas: o grupo anterior é gravado antes
+	if err := aw.flushSolid(); err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+	if err := ViktorCompress(data, dataType, width, &payload); err != nil {
+		return err
+	}
+
+	entry := ArchiveEntry{
+		Name:           filepath.ToSlash(name),
+		Size:           uint64(info.Size()),
+		CompressedSize: uint64(payload.Len()),
+		Offset:         aw.offset,
+		ModTime:        info.ModTime(),
+		Mode:           info.Mode().Perm(),
+		DataType:       dataType,
+	}
+
+	if _, err := aw.w.Write(payload.Bytes()); err != nil {
+		return err
+	}
+	aw.offset += entry.CompressedSize
+	aw.entries = append(aw.entries, entry)
+	return nil
+}
+
+// Comprime o grupo sólido em aberto como um único payload
+func (aw *ArchiveWriter) flushSolid() error {
+	if len(aw.solidPending) == 0 {
+		return nil
+	}
+
+	fmt.Printf("[Pack] Grupo sólido: %d entradas, %d bytes\n", len(aw.solidPending), aw.solidData.Len())
+
+	var payload bytes.Buffer
+	if err := ViktorCompress(aw.solidData.Bytes(), TYPE_TEXT, 0, &payload); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(payload.Bytes()); err != nil {
+		return err
+	}
+
+	for _, e := range aw.solidPending {
+		e.Offset = aw.offset
+		e.CompressedSize = uint64(payload.Len())
+		aw.entries = append(aw.entries, e)
+	}
+	aw.offset += uint64(payload.Len())
+
+	aw.solidData.Reset()
+	aw.solidPending = aw.solidPending[:0]
+	return nil
+}
+
+// Grava o diretório central e o trailer. O writer de baixo não é fechado.
+func (aw *ArchiveWriter) Close() error {
+	if err := aw.flushSolid(); err != nil {
+		return err
+	}
+
+	var dir bytes.Buffer
+	for _, e := range aw.entries {
+		writeArchiveEntry(&dir, e)
+	}
+
+	var trailer [archiveTrailerSize]byte
+	binary.LittleEndian.PutUint64(trailer[0:], aw.offset)
+	binary.LittleEndian.PutUint32(trailer[8:], uint32(len(aw.entries)))
+	copy(trailer[12:], ARCHIVE_TRAILER)
+
+	if _, err := aw.w.Write(dir.Bytes()); err != nil {
+		return err
+	}
+	_, err := aw.w.Write(trailer[:])
+	return err
+}
+
+// [nameLen uint16][name][size u64][compressed u64][offset u64][mtime i64][mode u32][type u8]
+// A partir do YSA2 seguem [flags u8][solidOffset u64].
+func writeArchiveEntry(w io.Writer, e ArchiveEntry) {
+	binary.Write(w, binary.LittleEndian, uint16(len(e.Name)))
+	io.WriteString(w, e.Name)
+	binary.Write(w, binary.LittleEndian, e.Size)
+	binary.Write(w, binary.LittleEndian, e.CompressedSize)
+	binary.Write(w, binary.LittleEndian, e.Offset)
+	binary.Write(w, binary.LittleEndian, e.ModTime.UnixNano())
+	binary.Write(w, binary.LittleEndian, uint32(e.Mode))
+	w.Write([]byte{e.DataType, e.Flags})
+	binary.Write(w, binary.LittleEndian, e.SolidOffset)
+}
+
+func readArchiveEntry(r io.Reader, version byte) (ArchiveEntry, error) {
+	var e ArchiveEntry
+
+	var nameLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+		return e, err
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return e, err
+	}
+	e.Name = string(name)
+
+	var fixed struct {
+		Size, CompressedSize, Offset uint64
+		ModTime                      int64
+		Mode                         uint32
+		DataType                     uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &fixed); err != nil {
+		return e, err
+	}
+
+	e.Size = fixed.Size
+	e.CompressedSize = fixed.CompressedSize
+	e.Offset = fixed.Offset
+	e.ModTime = time.Unix(0, fixed.ModTime)
+	e.Mode = fs.FileMode(fixed.Mode)
+	e.DataType = fixed.DataType
+
+	if version >= '2' {
+		var ext struct {
+			Flags       uint8
+			SolidOffset uint64
+		}
+		if err := binary.Read(r, binary.LittleEndian, &ext); err != nil {
+			return e, err
+		}
+		e.Flags = ext.Flags
+		e.SolidOffset = ext.SolidOffset
+	}
+	return e, nil
+}
+
+type ArchiveReader struct {
+	r       io.ReaderAt
+	Entries []ArchiveEntry
+}
+
+// Lê apenas o trailer e o diretório central; nenhum payload é descomprimido
+func OpenArchive(r io.ReaderAt, size int64) (*ArchiveReader, error) {
+	if size < int64(len(ARCHIVE_MAGIC))+archiveTrailerSize {
+		return nil, fmt.Errorf("arquivo pequeno demais para ser um .ysa")
+	}
+
+	magic := make([]byte, len(ARCHIVE_MAGIC))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if string(magic) != ARCHIVE_MAGIC && string(magic) != ARCHIVE_MAGIC_V1 {
+		return nil, fmt.Errorf("assinatura inválida: não é um arquivo .ysa")
+	}
+	version := magic[3]
+
+	var trailer [archiveTrailerSize]byte
+	if _, err := r.ReadAt(trailer[:], size-archiveTrailerSize); err != nil {
+		return nil, err
+	}
+	if string(trailer[12:]) != ARCHIVE_TRAILER {
+		return nil, fmt.Errorf("trailer ausente: arquivo .ysa truncado ou corrompido")
+	}
+
+	dirOffset := int64(binary.LittleEndian.Uint64(trailer[0:]))
+	numEntries := binary.LittleEndian.Uint32(trailer[8:])
+	if dirOffset < int64(len(ARCHIVE_MAGIC)) || dirOffset > size-archiveTrailerSize {
+		return nil, fmt.Errorf("offset do diretório inválido: %d", dirOffset)
+	}
+
+	dir := io.NewSectionReader(r, dirOffset, size-archiveTrailerSize-dirOffset)
+	entries := make([]ArchiveEntry, 0, numEntries)
+	for i := uint32(0); i < numEntries; i++ {
+		e, err := readArchiveEntry(dir, version)
+		if err != nil {
+			return nil, fmt.Errorf("diretório corrompido na entrada %d: %w", i, err)
+		}
+		if int64(e.Offset+e.CompressedSize) > dirOffset {
+			return nil, fmt.Errorf("entrada %q aponta para fora da área de dados", e.Name)
+		}
+		entries = append(entries, e)
+	}
+
+	return &ArchiveReader{r: r, Entries: entries}, nil
+}
+
+func (ar *ArchiveReader) Find(name string) (*ArchiveEntry, error) {
+	name = filepath.ToSlash(name)
+	for i := range ar.Entries {
+		if ar.Entries[i].Name == name {
+			return &ar.Entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("entrada %q não existe no arquivo", name)
+}
+
+// Descomprime somente o payload da entrada pedida. Para entradas sólidas o
+// grupo é decodificado do início até o fim da entrada; o resto é ignorado.
+func (ar *ArchiveReader) ReadEntry(e *ArchiveEntry) ([]byte, int, error) {
+	section := io.NewSectionReader(ar.r, int64(e.Offset), int64(e.CompressedSize))
+
+	if e.IsSolid() {
+		end := e.SolidOffset + e.Size
+		group, err := ViktorDecompressPrefix(section, int(end))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		if uint64(len(group)) < end {
+			return nil, 0, fmt.Errorf("%s: grupo sólido menor que o índice indica", e.Name)
+		}
+		return group[e.SolidOffset:end], 0, nil
+	}
+
+	restored, _, width, err := ViktorDecompressAndGetMetadata(section)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", e.Name, err)
+	}
+	return restored, width, nil
+}
+
+// Percorre o diretório em ordem lexical e adiciona cada arquivo regular.
+// skipPath evita que o próprio .ysa de saída entre no pack.
+func PackDirectory(root string, output io.Writer, skipPath string, solid bool) ([]ArchiveEntry, error) {
+	aw, err := NewArchiveWriter(output, solid)
+	if err != nil {
+		return nil, err
+	}
+
+	skipAbs, _ := filepath.Abs(skipPath)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); abs == skipAbs {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		data, dataType, err := loadArchiveInput(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("[Pack] %s (%d bytes)\n", rel, info.Size())
+		return aw.AddFile(rel, data, dataType, 0, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return aw.entries, aw.Close()
+}
+
+// O tipo vem do conteúdo. Imagens são guardadas byte a byte no modo
+// genérico: decodificar e recodificar um PNG devolveria os mesmos pixels,
+// mas não o mesmo arquivo (chunks de texto, compressão e filtros mudam).
+func loadArchiveInput(p string) ([]byte, uint8, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	det := DetectDataType(data)
+	if det.IsImage() {
+		return data, TYPE_BINARY, nil
+	}
+	return data, det.DataType, nil
+}
+
+// Extrai uma entrada para destDir restaurando permissões e mtime. Como no
+// decompress, sem force não sobrescreve um arquivo que já existe.
+func ExtractEntry(ar *ArchiveReader, e *ArchiveEntry, destDir string, force bool) (string, error) {
+	clean := path.Clean(e.Name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("nome de entrada inseguro: %q", e.Name)
+	}
+
+	kind, err := LookupKind(e.DataType)
+	if err != nil {
+		return "", err
+	}
+
+	data, width, err := ar.ReadEntry(e)
+	if err != nil {
+		return "", err
+	}
+
+	outPath := filepath.Join(destDir, filepath.FromSlash(clean))
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return "", err
+	}
+
+	err = writeOutputFile(outPath, e.Mode, e.ModTime, force, func(w io.Writer) error {
+		return kind.Reconstruct(w, data, width)
+	})
+	if err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
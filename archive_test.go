@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// No modo sólido os grupos recomeçam depois de SOLID_GROUP_LIMIT, e cada
+// entrada sai do próprio grupo, igual ao original
+func TestSolidArchiveRestarts(t *testing.T) {
+	dir := t.TempDir()
+	log := reproInputs()[0].data
+	want := map[string][]byte{}
+	for i := range 8 {
+		name := fmt.Sprintf("app.log.%d", i)
+		data := log[i*len(log)/16:]
+		want[name] = data
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := PackDirectory(dir, &buf, "", true); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := map[uint64]uint64{} // Offset do grupo -> fim da última entrada
+	for i := range ar.Entries {
+		e := &ar.Entries[i]
+		if !e.IsSolid() {
+			t.Fatalf("%s não é sólida", e.Name)
+		}
+		got, _, err := ar.ReadEntry(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[e.Name]) {
+			t.Fatalf("%s: conteúdo diferente do original", e.Name)
+		}
+		groups[e.Offset] = max(groups[e.Offset], e.SolidOffset+e.Size)
+	}
+	if len(groups) < 2 {
+		t.Fatalf("%d grupo(s): esperava reinícios depois de %d bytes", len(groups), SOLID_GROUP_LIMIT)
+	}
+	for offset, size := range groups {
+		if size > SOLID_GROUP_LIMIT+uint64(len(log)) {
+			t.Errorf("grupo em %d tem %d bytes", offset, size)
+		}
+	}
+}
+
+// O extract segue o decompress: não sobrescreve sem force e restaura
+// permissões e mtime
+func TestExtractEntryForce(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	data := reproInputs()[0].data
+	p := filepath.Join(src, "app.log")
+	if err := os.WriteFile(p, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(p)
+
+	var buf bytes.Buffer
+	if _, err := PackDirectory(src, &buf, "", false); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ar.Find("app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ExtractEntry(ar, e, dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	restored, _ := os.Stat(out)
+	if !bytes.Equal(got, data) || restored.Mode().Perm() != 0o600 || !restored.ModTime().Equal(info.ModTime()) {
+		t.Fatalf("entrada extraída difere: %v %v", restored.Mode(), restored.ModTime())
+	}
+
+	if err := os.WriteFile(out, []byte("outro"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractEntry(ar, e, dest, false); err == nil {
+		t.Fatal("sobrescreveu sem --force")
+	}
+	if got, _ := os.ReadFile(out); string(got) != "outro" {
+		t.Fatal("arquivo existente alterado sem --force")
+	}
+	if _, err := ExtractEntry(ar, e, dest, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Fatal("--force não trocou o conteúdo")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Um backend de entropia dos streams do payload. Cada um tem uma flag no
+// cabeçalho e no máximo uma delas pode estar ligada; sem nenhuma, os streams
+// são Huffman estático (huffman.go). Compressão e descompressão consultam
+// este registro em vez de testar as flags uma a uma.
+type StreamBackend struct {
+	Flag uint8
+
+	// O nível escolhe o buscador de matches e não vai para o cabeçalho
+	Encode func(data []byte, output io.Writer, isImage bool, level int) error
+	// Para depois de `limit` bytes (limit < 0 decodifica tudo)
+	Decode func(r io.Reader, limit int) ([]byte, error)
+}
+
+var streamBackends = []*StreamBackend{
+	{Flag: FLAG_BLOCKS, Encode: BlockCompressLevel, Decode: BlockDecompressPrefix},
+	{Flag: FLAG_ADAPTIVE, Encode: AdaptiveCompressLevel, Decode: AdaptiveDecompressPrefix},
+	{
+		Flag: FLAG_RLE,
+		Encode: func(data []byte, output io.Writer, isImage bool, level int) error {
+			return RLECompressStream(data, output, isImage)
+		},
+		Decode: RLEDecompressPrefix,
+	},
+}
+
+// Todas as flags de backend
+var backendFlags = func() (flags uint8) {
+	for _, b := range streamBackends {
+		flags |= b.Flag
+	}
+	return flags
+}()
+
+// O backend ligado nas flags do cabeçalho; nil para o Huffman estático
+func lookupBackend(flags uint8) (*StreamBackend, error) {
+	if n := bits.OnesCount8(flags & backendFlags); n > 1 {
+		return nil, fmt.Errorf("%d backends de entropia ligados nas flags (%#x); só um é permitido", n, flags&backendFlags)
+	}
+	for _, b := range streamBackends {
+		if flags&b.Flag != 0 {
+			return b, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Cada backend volta os dados; um cabeçalho com duas flags de backend é
+// recusado em vez de o decodificador escolher uma delas
+func TestStreamBackends(t *testing.T) {
+	data := reproInputs()[0].data[:20000]
+	for _, opts := range []Options{{Level: LEVEL_DEFAULT}, {Level: LEVEL_DEFAULT, Adaptive: true}, {Level: LEVEL_DEFAULT, RLE: true}} {
+		var buf bytes.Buffer
+		if err := ViktorCompressWithOptions(data, TYPE_TEXT, 0, opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.Bytes()
+		restored, err := ViktorDecompress(bytes.NewReader(out))
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Fatalf("flags %#x: %v", out[4], err)
+		}
+
+		for _, b := range streamBackends {
+			if out[4]&b.Flag != 0 {
+				continue
+			}
+			bad := bytes.Clone(out)
+			bad[4] |= b.Flag
+			if out[4]&backendFlags == 0 {
+				continue // Huffman estático + um backend é só outro backend
+			}
+			if _, err := ViktorDecompress(bytes.NewReader(bad)); err == nil {
+				t.Errorf("flags %#x aceitas", bad[4])
+			}
+		}
+	}
+}
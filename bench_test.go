@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// Benchmarks de CPU e alocação do codificador, sobre o log fixo de
+// repro_test.go repetido até ~1 MB
+func benchInput() []byte {
+	log := reproInputs()[0].data
+	data := make([]byte, 0, 1<<20+len(log))
+	for len(data) < 1<<20 {
+		data = append(data, log...)
+	}
+	return data
+}
+
+func benchLZ77(b *testing.B, level int) {
+	data := benchInput()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		LZ77CompressLevel(data, false, level)
+	}
+}
+
+func BenchmarkLZ77MultiHash(b *testing.B) { benchLZ77(b, LEVEL_FASTEST) }
+func BenchmarkLZ77HashChain(b *testing.B) { benchLZ77(b, LEVEL_DEFAULT) }
+func BenchmarkLZ77BT4(b *testing.B)       { benchLZ77(b, LEVEL_BEST) }
+
+func BenchmarkEncoderNew(b *testing.B) {
+	data := benchInput()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		NewEncoder(io.Discard).Encode(data, false)
+	}
+}
+
+func BenchmarkEncoderReset(b *testing.B) {
+	data := benchInput()
+	enc := NewEncoder(io.Discard)
+	enc.Encode(data, false) // Aquece os buffers
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		enc.Reset(io.Discard)
+		enc.Encode(data, false)
+	}
+}
+
+// Depois da primeira chamada, Reset + Encode não aloca
+func TestEncoderResetDoesNotAllocate(t *testing.T) {
+	for _, in := range reproInputs() {
+		for _, level := range []int{LEVEL_FASTEST, LEVEL_DEFAULT, LEVEL_BEST} {
+			enc := NewEncoder(io.Discard)
+			enc.SetLevel(level)
+			enc.Encode(in.data, in.width > 0)
+			allocs := testing.AllocsPerRun(5, func() {
+				enc.Reset(io.Discard)
+				enc.Encode(in.data, in.width > 0)
+			})
+			if allocs != 0 {
+				t.Errorf("%s, nível %d: %.0f alocações por Encode", in.name, level, allocs)
+			}
+		}
+	}
+}
+
+// Decodificação dos símbolos dos blocos (sem o LZ77 inverso)
+func benchDecode(b *testing.B, encode func([]LZ77Symbol) []byte, decode func([]byte, int) ([]LZ77Symbol, error)) {
+	data := benchInput()
+	blocks := splitBlocks(LZ77CompressLevel(data, false, LEVEL_DEFAULT))
+	payloads := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		payloads[i] = encode(block)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		for i, p := range payloads {
+			if _, err := decode(p, len(blocks[i])); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeTree(b *testing.B) {
+	benchDecode(b, encodeHuffmanBlock, decodeHuffmanBlock)
+}
+
+func BenchmarkDecodeFixed(b *testing.B) {
+	benchDecode(b, encodeFixedBlock, func(payload []byte, count int) ([]LZ77Symbol, error) {
+		return decodeCursorSymbols(payload, 0, &fixedTables, count)
+	})
+}
@@ -0,0 +1,266 @@
+package bitio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"testing/iotest"
+)
+
+type field struct {
+	val   uint64
+	nbits uint8
+}
+
+func randomFields(n int) []field {
+	rng := rand.New(rand.NewPCG(1, 2))
+	fields := make([]field, n)
+	for i := range fields {
+		nbits := uint8(rng.IntN(64) + 1)
+		fields[i] = field{rng.Uint64() & (1<<nbits - 1), nbits}
+	}
+	return fields
+}
+
+// Valores de 1 a 64 bits, bytes inteiros fora e dentro do alinhamento, nas
+// duas ordens; o leitor recebe um byte por Read
+func TestRoundTrip(t *testing.T) {
+	fields := randomFields(5000)
+	for _, order := range []uint8{MSB_FIRST, LSB_FIRST} {
+		var buf bytes.Buffer
+		bw := NewWriterOrder(&buf, order)
+		for i, f := range fields {
+			bw.WriteBits(f.val, f.nbits)
+			if i%500 == 0 {
+				bw.WriteBytes([]byte("xyz"))
+			}
+		}
+		total := bw.BitPos()
+		if err := bw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if want := (total + 7) / 8; uint64(buf.Len()) != want {
+			t.Fatalf("ordem %d: %d bytes, esperava %d", order, buf.Len(), want)
+		}
+
+		for _, src := range []io.Reader{bytes.NewReader(buf.Bytes()), iotest.OneByteReader(bytes.NewReader(buf.Bytes()))} {
+			br := NewReaderOrder(src, order)
+			for i, f := range fields {
+				if got, err := br.ReadBits(f.nbits); err != nil || got != f.val {
+					t.Fatalf("ordem %d, campo %d (%d bits): %#x, %v; esperava %#x", order, i, f.nbits, got, err, f.val)
+				}
+				if i%500 == 0 {
+					for _, c := range []byte("xyz") {
+						if got, _ := br.ReadBits(8); byte(got) != c {
+							t.Fatalf("ordem %d, campo %d: byte %#x, esperava %q", order, i, got, c)
+						}
+					}
+				}
+			}
+			if br.BitPos() != total {
+				t.Fatalf("ordem %d: BitPos %d, esperava %d", order, br.BitPos(), total)
+			}
+		}
+	}
+}
+
+// A posição dos bits no byte: o MSB começa no topo, o LSB no bit 0 (DEFLATE)
+func TestBitOrder(t *testing.T) {
+	for _, tc := range []struct {
+		order uint8
+		want  []byte
+	}{
+		{MSB_FIRST, []byte{0b1_10_00000, 0xAB, 0xCD}},
+		{LSB_FIRST, []byte{0b00000_10_1, 0xCD, 0xAB}},
+	} {
+		var buf bytes.Buffer
+		bw := NewWriterOrder(&buf, tc.order)
+		bw.WriteBits(1, 1)
+		bw.WriteBits(0b10, 2)
+		bw.Align()
+		bw.WriteBits(0xABCD, 16)
+		bw.Flush()
+		if !bytes.Equal(buf.Bytes(), tc.want) {
+			t.Errorf("ordem %d: %08b, esperava %08b", tc.order, buf.Bytes(), tc.want)
+		}
+	}
+}
+
+// Leituras de mais de 56 bits vêm em duas partes e não dependem do
+// alinhamento
+func TestReadOver56Bits(t *testing.T) {
+	for _, order := range []uint8{MSB_FIRST, LSB_FIRST} {
+		for _, nbits := range []uint8{57, 60, 63, 64} {
+			val := uint64(0xF0E1D2C3B4A59687) & (1<<nbits - 1)
+			if nbits == 64 {
+				val = 0xF0E1D2C3B4A59687
+			}
+			var buf bytes.Buffer
+			bw := NewWriterOrder(&buf, order)
+			bw.WriteBits(0b101, 3)
+			bw.WriteBits(val, nbits)
+			bw.WriteBits(val, nbits)
+			bw.Flush()
+
+			br := NewReaderOrder(&buf, order)
+			br.ReadBits(3)
+			for range 2 {
+				if got, err := br.ReadBits(nbits); err != nil || got != val {
+					t.Fatalf("ordem %d, %d bits: %#x, %v; esperava %#x", order, nbits, got, err, val)
+				}
+			}
+		}
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 16))).ReadBits(65); err == nil {
+		t.Fatal("leitura de 65 bits aceita")
+	}
+}
+
+func TestPeekSkip(t *testing.T) {
+	br := NewReader(bytes.NewReader([]byte{0b1011_0011, 0xFF}))
+	if got := br.PeekBits(4); got != 0b1011 {
+		t.Fatalf("PeekBits(4) = %04b", got)
+	}
+	if got := br.PeekBits(6); got != 0b1011_00 || br.BitPos() != 0 {
+		t.Fatalf("PeekBits(6) = %06b, BitPos %d", got, br.BitPos())
+	}
+	if err := br.SkipBits(5); err != nil || br.BitPos() != 5 {
+		t.Fatalf("SkipBits(5): %v, BitPos %d", err, br.BitPos())
+	}
+	if got, _ := br.ReadBits(3); got != 0b011 {
+		t.Fatalf("ReadBits(3) = %03b", got)
+	}
+	// Depois do fim o Peek completa com zeros
+	if got := br.PeekBits(12); got != 0xFF0 {
+		t.Fatalf("PeekBits(12) no fim = %#x", got)
+	}
+}
+
+// O fim antes da hora vira io.ErrUnexpectedEOF e fica: toda leitura
+// seguinte falha com o mesmo erro
+func TestEOFIsSticky(t *testing.T) {
+	br := NewReader(bytes.NewReader([]byte{0xAB, 0xCD}))
+	if got, err := br.ReadBits(12); err != nil || got != 0xABC {
+		t.Fatalf("ReadBits(12) = %#x, %v", got, err)
+	}
+	if _, err := br.ReadBits(5); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadBits depois do fim: %v", err)
+	}
+	if br.BitPos() != 12 {
+		t.Fatalf("BitPos %d depois da leitura que falhou", br.BitPos())
+	}
+	if _, err := br.ReadBits(1); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("erro não ficou guardado: %v", err)
+	}
+	if err := br.SkipBits(0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("SkipBits depois do erro: %v", err)
+	}
+	if err := br.ReadAlignedBytes(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadAlignedBytes depois do erro: %v", err)
+	}
+	if !errors.Is(br.Err(), io.ErrUnexpectedEOF) {
+		t.Fatalf("Err() = %v", br.Err())
+	}
+
+	// Erros do reader de baixo também ficam
+	boom := errors.New("boom")
+	br = NewReader(iotest.ErrReader(boom))
+	if _, err := br.ReadBits(8); !errors.Is(err, boom) {
+		t.Fatalf("erro do reader: %v", err)
+	}
+	if _, err := br.ReadBits(1); !errors.Is(err, boom) || !errors.Is(br.Err(), boom) {
+		t.Fatalf("erro do reader não ficou guardado: %v", err)
+	}
+}
+
+// Bytes alinhados maiores que o buffer interno saem direto do reader
+func TestReadAlignedBytes(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	var buf bytes.Buffer
+	bw := NewWriter(&buf)
+	bw.WriteBits(0b11, 2)
+	bw.Align()
+	bw.WriteBytes(payload)
+	bw.WriteBits(0x5, 3)
+	bw.Flush()
+
+	br := NewReader(&buf)
+	br.ReadBits(2)
+	got := make([]byte, len(payload))
+	if err := br.ReadAlignedBytes(got); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("ReadAlignedBytes: %v", err)
+	}
+	if v, err := br.ReadBits(3); err != nil || v != 0x5 {
+		t.Fatalf("depois dos bytes: %#x, %v", v, err)
+	}
+}
+
+type failWriter struct{ n int }
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.n += len(p); w.n > 8 {
+		return 0, errors.New("disco cheio")
+	}
+	return len(p), nil
+}
+
+// O primeiro erro de escrita fica guardado e o Flush devolve ele
+func TestWriterErrorIsSticky(t *testing.T) {
+	bw := NewWriter(&failWriter{})
+	for range 10000 {
+		bw.WriteBits(0xFFFF, 16)
+	}
+	err := bw.Flush()
+	if err == nil || err.Error() != "disco cheio" {
+		t.Fatalf("Flush: %v", err)
+	}
+	if bw.WriteBits(1, 1) != err || bw.WriteBytes([]byte{1}) != err || bw.Err() != err {
+		t.Fatal("erro de escrita não ficou guardado")
+	}
+
+	bw.Reset(io.Discard)
+	if bw.Err() != nil || bw.BitPos() != 0 {
+		t.Fatal("Reset não limpou o estado")
+	}
+}
+
+func TestCursor(t *testing.T) {
+	fields := randomFields(2000)
+	var buf bytes.Buffer
+	bw := NewWriter(&buf)
+	for _, f := range fields {
+		bw.WriteBits(f.val, f.nbits)
+	}
+	total := bw.BitPos()
+	bw.Flush()
+
+	c := NewCursor(buf.Bytes())
+	for i, f := range fields {
+		// Campos de até 56 bits de uma vez, os maiores em duas partes
+		var got uint64
+		for rest := f.nbits; rest > 0; {
+			n := min(rest, 32)
+			c.Refill32()
+			got = got<<n | c.Peek(n)
+			c.Skip(n)
+			rest -= n
+		}
+		if got != f.val {
+			t.Fatalf("campo %d (%d bits): %#x, esperava %#x", i, f.nbits, got, f.val)
+		}
+	}
+	c.Skip(uint8(-total & 7)) // Zeros do alinhamento do Flush
+	if c.Overrun() {
+		t.Fatal("Overrun no fim exato dos dados")
+	}
+	c.Refill()
+	if c.Peek(8) != 0 {
+		t.Fatal("bits depois do fim não são zero")
+	}
+	c.Skip(1)
+	if !c.Overrun() {
+		t.Fatal("sem Overrun depois do fim")
+	}
+}
@@ -0,0 +1,66 @@
+package bitio
+
+import "encoding/binary"
+
+// Cursor de leitura sobre bytes já em memória, na mesma ordem de bits do
+// Reader (MSB primeiro). Sem bufio e sem erros por chamada: recarrega 8
+// bytes de uma vez, lê zeros depois do fim e Overrun diz se algum desses
+// bits foi consumido. É o laço interno dos decodificadores por tabela.
+type Cursor struct {
+	data []byte
+	pos  int    // Próximo byte a entrar no cache
+	buf  uint64 // Bits válidos alinhados à esquerda
+	n    uint8  // Quantos bits válidos há em buf
+}
+
+func NewCursor(data []byte) Cursor {
+	c := Cursor{data: data}
+	c.Refill()
+	return c
+}
+
+// Garante pelo menos 56 bits no cache
+func (c *Cursor) Refill() {
+	if c.pos+8 <= len(c.data) {
+		c.buf |= binary.BigEndian.Uint64(c.data[c.pos:]) >> c.n
+		c.pos += int(63-c.n) >> 3
+		c.n |= 56
+		return
+	}
+	for c.n <= 56 {
+		var b byte
+		if c.pos < len(c.data) {
+			b = c.data[c.pos]
+		}
+		c.pos++
+		c.buf |= uint64(b) << (56 - c.n)
+		c.n += 8
+	}
+}
+
+// Recarrega só se restarem menos de 32 bits
+func (c *Cursor) Refill32() {
+	if c.n < 32 {
+		c.Refill()
+	}
+}
+
+// Os próximos nbits, sem consumir (nbits <= n)
+func (c *Cursor) Peek(nbits uint8) uint64 {
+	return c.buf >> (64 - nbits)
+}
+
+// Bits válidos no cache
+func (c *Cursor) Bits() uint8 {
+	return c.n
+}
+
+func (c *Cursor) Skip(nbits uint8) {
+	c.buf <<= nbits
+	c.n -= nbits
+}
+
+// Algum bit depois do fim dos dados foi consumido
+func (c *Cursor) Overrun() bool {
+	return c.pos*8-int(c.n) > len(c.data)*8
+}
@@ -0,0 +1,227 @@
+// Package bitio lê e grava streams de bits, nas duas ordens de bits dentro
+// do byte: Reader e Writer sobre io.Reader/io.Writer, com erros guardados, e
+// Cursor sobre bytes já em memória, para os laços de decodificação.
+package bitio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Ordem dos bits dentro de cada byte, para Reader e Writer
+const (
+	MSB_FIRST = 0 // Primeiro bit no topo do byte, valores do bit mais alto para o mais baixo (o formato .ys)
+	LSB_FIRST = 1 // Primeiro bit no bit 0 do byte, valores do mais baixo para o mais alto (como o DEFLATE)
+)
+
+const readerBufSize = 4096
+
+// Leitor de bits com cache de 64 bits, recarregado 8 bytes por vez a partir
+// de um buffer próprio. PeekBits/SkipBits permitem decodificar por tabela:
+// olha os próximos bits, consome só o comprimento do código. O primeiro erro
+// fica guardado (Err) e toda leitura seguinte falha com ele.
+type Reader struct {
+	reader     io.Reader
+	buf        []byte // Bytes já lidos de reader e ainda fora do cache
+	start, end int
+	cache      uint64 // MSB: bits alinhados à esquerda; LSB: à direita
+	bits       uint8  // Quantos bits úteis ainda restam no cache
+	order      uint8  // MSB_FIRST ou LSB_FIRST
+	pos        uint64 // Bits consumidos desde o início
+	eof        bool
+	err        error
+}
+
+func NewReader(r io.Reader) *Reader {
+	return NewReaderOrder(r, MSB_FIRST)
+}
+
+func NewReaderOrder(r io.Reader, order uint8) *Reader {
+	return &Reader{
+		reader: r,
+		buf:    make([]byte, readerBufSize),
+		order:  order,
+	}
+}
+
+// Traz mais bytes do reader para o buffer, preservando os que sobraram
+func (br *Reader) fillBuffer() {
+	if br.eof || br.err != nil {
+		return
+	}
+	br.end = copy(br.buf, br.buf[br.start:br.end])
+	br.start = 0
+	n, err := br.reader.Read(br.buf[br.end:])
+	br.end += n
+	if err == io.EOF {
+		br.eof = true
+	} else if err != nil {
+		br.err = err
+	}
+}
+
+// Completa o cache: 8 bytes de uma vez enquanto o buffer tem pelo menos 8,
+// byte a byte no fim do buffer. Os bits que vêm junto além de `bits` são os
+// próprios bytes seguintes, então relê-los na próxima recarga não muda nada.
+// Só chama o reader com o buffer vazio: num stream ao vivo (adaptive.go) o
+// Read bloqueia até o próximo flush do outro lado.
+func (br *Reader) refill() {
+	if br.start == br.end {
+		br.fillBuffer()
+	}
+	if br.end-br.start >= 8 {
+		consumed := (63 - br.bits) >> 3
+		if br.order == LSB_FIRST {
+			br.cache |= binary.LittleEndian.Uint64(br.buf[br.start:]) << br.bits
+		} else {
+			br.cache |= binary.BigEndian.Uint64(br.buf[br.start:]) >> br.bits
+		}
+		br.start += int(consumed)
+		br.bits += consumed * 8
+		return
+	}
+	for br.bits <= 56 && br.start < br.end {
+		b := uint64(br.buf[br.start])
+		if br.order == LSB_FIRST {
+			br.cache |= b << br.bits
+		} else {
+			br.cache |= b << (56 - br.bits)
+		}
+		br.start++
+		br.bits += 8
+	}
+}
+
+// Recarrega até ter nbits no cache ou o stream acabar. Readers que devolvem
+// poucos bytes por Read (rede, pipes) precisam de várias voltas.
+func (br *Reader) ensure(nbits uint8) {
+	for br.bits < nbits {
+		before := br.bits
+		br.refill()
+		if br.bits == before && (br.eof || br.err != nil) {
+			return
+		}
+	}
+}
+
+// Os próximos nbits (até 56) sem consumir. Depois do fim do stream os bits
+// que faltam vêm zerados; só o SkipBits acusa o erro.
+func (br *Reader) PeekBits(nbits uint8) uint64 {
+	br.ensure(nbits)
+	if nbits == 0 {
+		return 0
+	}
+	if br.order == LSB_FIRST {
+		return br.cache & (1<<nbits - 1)
+	}
+	return br.cache >> (64 - nbits)
+}
+
+// Consome nbits (até 56) já vistos pelo PeekBits
+func (br *Reader) SkipBits(nbits uint8) error {
+	if br.err != nil {
+		return br.err
+	}
+	if br.bits < nbits {
+		br.ensure(nbits)
+		if br.bits < nbits {
+			if br.err == nil {
+				br.err = io.ErrUnexpectedEOF
+			}
+			return br.err
+		}
+	}
+	if br.order == LSB_FIRST {
+		br.cache >>= nbits
+	} else {
+		br.cache <<= nbits
+	}
+	br.bits -= nbits
+	br.pos += uint64(nbits)
+	return nil
+}
+
+// Lê nbits (até 64) como um valor
+func (br *Reader) ReadBits(nbits uint8) (uint64, error) {
+	// Caminho rápido: os bits já estão no cache
+	if nbits <= br.bits && br.err == nil {
+		var val uint64
+		if br.order == LSB_FIRST {
+			val = br.cache & (1<<nbits - 1)
+			br.cache >>= nbits
+		} else {
+			val = br.cache >> (64 - nbits)
+			br.cache <<= nbits
+		}
+		br.bits -= nbits
+		br.pos += uint64(nbits)
+		return val, nil
+	}
+	if nbits > 56 {
+		if nbits > 64 {
+			return 0, fmt.Errorf("leitura de %d bits (máximo 64)", nbits)
+		}
+		// Em duas partes; no LSB os bits baixos do valor vêm primeiro
+		if br.order == LSB_FIRST {
+			lo, _ := br.ReadBits(32)
+			hi, err := br.ReadBits(nbits - 32)
+			return hi<<32 | lo, err
+		}
+		hi, _ := br.ReadBits(nbits - 32)
+		lo, err := br.ReadBits(32)
+		return hi<<32 | lo, err
+	}
+
+	val := br.PeekBits(nbits)
+	if err := br.SkipBits(nbits); err != nil {
+		return 0, err
+	}
+	return val, nil
+}
+
+// Descarta o resto do byte atual
+func (br *Reader) ByteAlign() {
+	br.SkipBits(uint8(-br.pos & 7))
+}
+
+// Descarta o resto do byte atual e lê len(p) bytes inteiros
+func (br *Reader) ReadAlignedBytes(p []byte) error {
+	br.ByteAlign()
+	if br.err != nil {
+		return br.err
+	}
+	n := 0
+	for ; n < len(p) && br.bits >= 8; n++ {
+		v, _ := br.ReadBits(8)
+		p[n] = byte(v)
+	}
+	if n == len(p) {
+		return nil
+	}
+
+	// Cache vazio: o resto sai direto do buffer e do reader. Os bits que a
+	// recarga trouxe a mais deixam de valer.
+	br.cache = 0
+	direct := copy(p[n:], br.buf[br.start:br.end])
+	br.start += direct
+	if n+direct < len(p) {
+		read, err := io.ReadFull(br.reader, p[n+direct:])
+		direct += read
+		if err != nil {
+			br.err = err
+		}
+	}
+	br.pos += uint64(8 * direct)
+	return br.err
+}
+
+// Bits consumidos desde o início
+func (br *Reader) BitPos() uint64 {
+	return br.pos
+}
+
+// O primeiro erro de leitura, inclusive o fim do stream antes da hora
+func (br *Reader) Err() error {
+	return br.err
+}
@@ -0,0 +1,140 @@
+package bitio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Escritor de bits com cache de 64 bits, esvaziado 4 bytes por vez. Erros de
+// escrita ficam guardados: as chamadas seguintes viram no-op e o Flush
+// devolve o primeiro, então quem só grava códigos pode conferir uma vez no
+// fim.
+type Writer struct {
+	writer *bufio.Writer // bufio é essencial para performance de disco
+	cache  uint64        // Bits pendentes: MSB com o mais antigo no topo, LSB no bit 0
+	bits   uint8         // Quantos bits estão ocupados no cache
+	order  uint8         // MSB_FIRST ou LSB_FIRST
+	pos    uint64        // Bits gravados desde o início (ou o último Reset)
+	err    error
+	word   [4]byte // Fora da pilha escaparia para o heap a cada WriteBits
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return NewWriterOrder(w, MSB_FIRST)
+}
+
+func NewWriterOrder(w io.Writer, order uint8) *Writer {
+	return &Writer{
+		writer: bufio.NewWriter(w),
+		order:  order,
+	}
+}
+
+// Reaproveita o Writer (e o buffer do bufio) para outro destino
+func (bw *Writer) Reset(w io.Writer) {
+	bw.writer.Reset(w)
+	bw.cache = 0
+	bw.bits = 0
+	bw.pos = 0
+	bw.err = nil
+}
+
+// Grava os nbits (até 64) menos significativos de val
+func (bw *Writer) WriteBits(val uint64, nbits uint8) error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if nbits > 32 {
+		// Em duas partes; no LSB os bits baixos do valor vão primeiro
+		if bw.order == LSB_FIRST {
+			bw.WriteBits(val, 32)
+			return bw.WriteBits(val>>32, nbits-32)
+		}
+		bw.WriteBits(val>>32, nbits-32)
+		return bw.WriteBits(val, 32)
+	}
+
+	val &= 1<<nbits - 1
+	if bw.order == LSB_FIRST {
+		bw.cache |= val << bw.bits
+	} else {
+		bw.cache = bw.cache<<nbits | val
+	}
+	bw.bits += nbits
+	bw.pos += uint64(nbits)
+
+	// Até 31 pendentes + 32 novos cabem no cache
+	if bw.bits >= 32 {
+		if bw.order == LSB_FIRST {
+			binary.LittleEndian.PutUint32(bw.word[:], uint32(bw.cache))
+			bw.cache >>= 32
+		} else {
+			binary.BigEndian.PutUint32(bw.word[:], uint32(bw.cache>>(bw.bits-32)))
+		}
+		bw.bits -= 32
+		bw.cache &= 1<<bw.bits - 1
+		_, bw.err = bw.writer.Write(bw.word[:])
+	}
+	return bw.err
+}
+
+// Passa para o bufio os bytes completos do cache
+func (bw *Writer) flushBytes() error {
+	for bw.bits >= 8 && bw.err == nil {
+		if bw.order == LSB_FIRST {
+			bw.err = bw.writer.WriteByte(byte(bw.cache))
+			bw.cache >>= 8
+		} else {
+			bw.err = bw.writer.WriteByte(byte(bw.cache >> (bw.bits - 8)))
+		}
+		bw.bits -= 8
+		bw.cache &= 1<<bw.bits - 1
+	}
+	return bw.err
+}
+
+// Grava bytes inteiros. Com bits pendentes no cache eles continuam alinhados
+// aos bits, como se cada byte passasse pelo WriteBits.
+func (bw *Writer) WriteBytes(p []byte) error {
+	if bw.bits%8 != 0 {
+		for _, b := range p {
+			bw.WriteBits(uint64(b), 8)
+		}
+		return bw.err
+	}
+	if bw.flushBytes() != nil {
+		return bw.err
+	}
+	_, bw.err = bw.writer.Write(p)
+	bw.pos += 8 * uint64(len(p))
+	return bw.err
+}
+
+// Completa o byte atual com zeros; o próximo WriteBits começa num byte novo
+func (bw *Writer) Align() error {
+	if pad := -bw.pos & 7; pad > 0 {
+		bw.WriteBits(0, uint8(pad))
+	}
+	return bw.flushBytes()
+}
+
+// Bits gravados desde o início (ou o último Reset), contando o alinhamento
+func (bw *Writer) BitPos() uint64 {
+	return bw.pos
+}
+
+// O primeiro erro de escrita; depois dele os Write* não gravam mais nada
+func (bw *Writer) Err() error {
+	return bw.err
+}
+
+// Escreve os bits restantes se o último byte não estiver completo e devolve
+// o primeiro erro de escrita, se houve algum
+func (bw *Writer) Flush() error {
+	if bw.Align() != nil {
+		return bw.err
+	}
+	bw.err = bw.writer.Flush()
+	return bw.err
+}
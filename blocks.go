@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"yoursync/bitio"
+)
+
+// Payload em blocos (FLAG_BLOCKS). O LZ77 roda sobre o buffer inteiro, mas a
+// sequência de símbolos é cortada em blocos e cada bloco usa o backend de
+// entropia que ficar menor: Huffman com árvores próprias, Huffman com a
+// tabela fixa (fixedhuffman.go), tANS (tans.go) ou os bytes crus.
+//
+//	[tamanho original u32][blocos u32]
+//	por bloco: [tipo u8][símbolos u32][bytes u32][payload]
+//
+// Os matches podem apontar para blocos anteriores; só o par
+// comprimento/distância nunca é separado.
+const (
+	BLOCK_TANS          = 1
+	BLOCK_HUFFMAN_SPLIT = 2 // Árvores de literais e de distâncias (mesmo formato do HuffmanCompress)
+	BLOCK_FIXED         = 3 // Códigos da tabela fixa, sem árvores
+	BLOCK_STORED        = 4 // Os bytes que o bloco cobre, sem compressão
+
+	blockSymbols = 1 << 16
+)
+
+func BlockCompress(data []byte, output io.Writer, isImage bool) error {
+	return BlockCompressLevel(data, output, isImage, 0)
+}
+
+func BlockCompressLevel(data []byte, output io.Writer, isImage bool, level int) error {
+	symbols := LZ77CompressLevel(data, isImage, level)
+	fmt.Printf("[Compress] Símbolos LZ77 gerados: %d\n", len(symbols))
+	blocks := splitBlocks(symbols)
+
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(blocks)))
+	if _, err := output.Write(prefix[:]); err != nil {
+		return err
+	}
+
+	var used [5]int
+	offset := 0
+	for _, block := range blocks {
+		span := blockSpan(block)
+		raw := data[offset : offset+span]
+		offset += span
+
+		blockType, payload := uint8(BLOCK_HUFFMAN_SPLIT), encodeHuffmanBlock(block)
+		if alt := encodeFixedBlock(block); len(alt) < len(payload) {
+			blockType, payload = BLOCK_FIXED, alt
+		}
+		if alt := encodeTANSBlock(block); len(alt) < len(payload) {
+			blockType, payload = BLOCK_TANS, alt
+		}
+		if len(raw) < len(payload) {
+			blockType, payload = BLOCK_STORED, raw
+		}
+		used[blockType]++
+
+		var head [9]byte
+		head[0] = blockType
+		binary.LittleEndian.PutUint32(head[1:], uint32(len(block)))
+		binary.LittleEndian.PutUint32(head[5:], uint32(len(payload)))
+		if _, err := output.Write(head[:]); err != nil {
+			return err
+		}
+		if _, err := output.Write(payload); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[Compress] %d blocos (%d em tANS, %d na tabela fixa, %d crus)\n",
+		len(blocks), used[BLOCK_TANS], used[BLOCK_FIXED], used[BLOCK_STORED])
+	return nil
+}
+
+// Corta a sequência em blocos de até blockSymbols (+1) símbolos
+func splitBlocks(symbols []LZ77Symbol) [][]LZ77Symbol {
+	var blocks [][]LZ77Symbol
+	for len(symbols) > 0 {
+		n := min(blockSymbols, len(symbols))
+		if code := symbols[n-1].Code(); code >= 257 && code <= 285 && n < len(symbols) {
+			n++ // Leva a distância junto
+		}
+		blocks = append(blocks, symbols[:n])
+		symbols = symbols[n:]
+	}
+	return blocks
+}
+
+func BlockDecompress(r io.Reader) ([]byte, error) {
+	return BlockDecompressPrefix(r, -1)
+}
+
+// Como o HuffmanDecompressPrefix: para depois de `limit` bytes (limit < 0
+// decodifica tudo) sem ler os blocos seguintes
+func BlockDecompressPrefix(r io.Reader, limit int) ([]byte, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	total := int(binary.LittleEndian.Uint32(prefix[0:]))
+	numBlocks := binary.LittleEndian.Uint32(prefix[4:])
+
+	target := total
+	if limit >= 0 && limit < total {
+		target = limit
+	}
+
+	result := make([]byte, 0, target)
+	for b := uint32(0); b < numBlocks && len(result) < target; b++ {
+		var head [9]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return nil, fmt.Errorf("bloco %d: %w", b, err)
+		}
+		count := int(binary.LittleEndian.Uint32(head[1:]))
+		payload := make([]byte, binary.LittleEndian.Uint32(head[5:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, fmt.Errorf("bloco %d: %w", b, err)
+		}
+
+		var symbols []LZ77Symbol
+		var err error
+		switch head[0] {
+		case BLOCK_HUFFMAN_SPLIT:
+			symbols, err = decodeHuffmanBlock(payload, count)
+		case BLOCK_FIXED:
+			symbols, err = decodeCursorSymbols(payload, 0, &fixedTables, count)
+		case BLOCK_TANS:
+			symbols, err = decodeTANSBlock(payload, count)
+		case BLOCK_STORED:
+			result = append(result, payload...)
+			continue
+		default:
+			err = fmt.Errorf("tipo de bloco desconhecido: %d", head[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bloco %d: %w", b, err)
+		}
+
+		result, err = expandSymbols(result, symbols)
+		if err != nil {
+			return nil, fmt.Errorf("bloco %d: %w", b, err)
+		}
+	}
+
+	if len(result) > target {
+		result = result[:target]
+	}
+	if limit < 0 && len(result) != total {
+		return nil, fmt.Errorf("payload com %d bytes, esperado %d", len(result), total)
+	}
+	fmt.Printf("[Decompress] Sucesso! Total: %d bytes\n", len(result))
+	return result, nil
+}
+
+func encodeHuffmanBlock(symbols []LZ77Symbol) []byte {
+	trees := buildHuffmanTrees(symbols)
+
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	trees.write(bw)
+	for _, s := range symbols {
+		trees.writeSymbol(bw, s)
+	}
+	bw.Flush()
+	return buf.Bytes()
+}
+
+func encodeFixedBlock(symbols []LZ77Symbol) []byte {
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	for _, s := range symbols {
+		fixedTrees.writeSymbol(bw, s)
+	}
+	bw.Flush()
+	return buf.Bytes()
+}
+
+// Quantos bytes da entrada os símbolos cobrem
+func blockSpan(symbols []LZ77Symbol) int {
+	span := 0
+	for _, s := range symbols {
+		switch code := s.Code(); {
+		case code < 256:
+			span++
+		case code >= 257 && code <= 285:
+			base, _ := GetLengthBase(code)
+			span += base + s.ExtraVal()
+		}
+	}
+	return span
+}
+
+func decodeHuffmanBlock(payload []byte, count int) ([]LZ77Symbol, error) {
+	br := bitio.NewReader(bytes.NewReader(payload))
+	trees, err := readHuffmanTrees(br)
+	if err != nil {
+		return nil, err
+	}
+	tables := [2]*huffTable{newHuffTable(trees.lit), newHuffTable(trees.dist)}
+	return decodeCursorSymbols(payload, br.BitPos(), &tables, count)
+}
+
+// Lê os bits extras que o código exige (comprimentos e distâncias)
+func readExtraBits(br *bitio.Reader, code int) (LZ77Symbol, error) {
+	var extraBits int
+	switch {
+	case code >= 257 && code <= 285:
+		_, extraBits = GetLengthBase(code)
+	case code >= 300 && code <= 331:
+		_, extraBits = GetDistanceBase(code)
+	}
+	if extraBits == 0 {
+		return LZ77Symbol(code), nil
+	}
+	v, err := br.ReadBits(uint8(extraBits))
+	if err != nil {
+		return LZ77Symbol(code), err
+	}
+	return newLZ77Symbol(code, extraBits, int(v)), nil
+}
+
+// Aplica os símbolos de um bloco sobre o que já foi decodificado
+func expandSymbols(result []byte, symbols []LZ77Symbol) ([]byte, error) {
+	for i := 0; i < len(symbols); i++ {
+		code := symbols[i].Code()
+		switch {
+		case code < 256:
+			result = append(result, byte(code))
+		case code == 256:
+			return result, nil
+		case code >= 257 && code <= 285:
+			if i+1 >= len(symbols) {
+				return nil, fmt.Errorf("comprimento sem distância no fim do bloco")
+			}
+			baseLen, _ := GetLengthBase(code)
+			length := baseLen + symbols[i].ExtraVal()
+
+			i++
+			distCode := symbols[i].Code()
+			if distCode < 300 || distCode > 331 {
+				return nil, fmt.Errorf("Erro de Sincronia: Lido símbolo %d onde deveria ser uma Distância (300-331) na pos %d", distCode, len(result))
+			}
+			baseDist, _ := GetDistanceBase(distCode)
+			dist := baseDist + symbols[i].ExtraVal()
+			if dist > len(result) {
+				return nil, fmt.Errorf("distância inválida: %d na pos %d", dist, len(result))
+			}
+
+			for range length {
+				result = append(result, result[len(result)-dist])
+			}
+		default:
+			return nil, fmt.Errorf("símbolo desconhecido detectado: %d", code)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import "fmt"
+
+// Transformadas de cor reversíveis, aplicadas antes do filtro 2D em imagens
+// RGB/RGBA de 8 bits. Todas são escritas como passos de lifting sobre bytes
+// (mod 256): cada passo soma a um canal uma função dos canais já gravados, e
+// o inverso subtrai exatamente o mesmo valor. Por isso nenhuma precisa do bit
+// extra que Co/Cg/Cb/Cr teriam em aritmética inteira comum. O alpha nunca é
+// tocado.
+const (
+	TRANSFORM_NONE           = 0
+	TRANSFORM_SUBTRACT_GREEN = 1 // WebP lossless: R-G, G, B-G
+	TRANSFORM_YCOCG_R        = 2 // Y, Co, Cg com lifting (Malvar/Sullivan)
+	TRANSFORM_RCT            = 3 // RCT do JPEG 2000: Y, Cb, Cr
+
+	numTransforms = 4
+
+	// Não é gravado: escolhe a transformada pela entropia estimada
+	TRANSFORM_AUTO = 0xFF
+
+	transformSampleRows = 256 // Linhas usadas na estimativa do TRANSFORM_AUTO
+)
+
+// A divisão por 2/4 usa o byte como int8, para que diferenças negativas
+// pequenas continuem pequenas
+func half(v byte) byte    { return byte(int8(v) >> 1) }
+func quarter(v byte) byte { return byte(int8(v) >> 2) }
+
+func forwardColor(t uint8, r, g, b byte) (byte, byte, byte) {
+	switch t {
+	case TRANSFORM_SUBTRACT_GREEN:
+		return r - g, g, b - g
+	case TRANSFORM_YCOCG_R:
+		co := r - b
+		tmp := b + half(co)
+		cg := g - tmp
+		y := tmp + half(cg)
+		return y, co, cg
+	case TRANSFORM_RCT:
+		cb := b - g
+		cr := r - g
+		y := g + quarter(cb+cr)
+		return y, cb, cr
+	}
+	return r, g, b
+}
+
+func inverseColor(t uint8, c0, c1, c2 byte) (byte, byte, byte) {
+	switch t {
+	case TRANSFORM_SUBTRACT_GREEN:
+		g := c1
+		return c0 + g, g, c2 + g
+	case TRANSFORM_YCOCG_R:
+		y, co, cg := c0, c1, c2
+		tmp := y - half(cg)
+		g := cg + tmp
+		b := tmp - half(co)
+		return b + co, g, b
+	case TRANSFORM_RCT:
+		y, cb, cr := c0, c1, c2
+		g := y - quarter(cb+cr)
+		return cr + g, g, cb + g
+	}
+	return c0, c1, c2
+}
+
+// channels é 3 ou 4; com 4 o quarto byte (alpha) é copiado
+func ApplyColorTransform(data []byte, channels int, t uint8) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	if t == TRANSFORM_NONE {
+		return out
+	}
+	for i := 0; i+2 < len(out); i += channels {
+		out[i], out[i+1], out[i+2] = forwardColor(t, data[i], data[i+1], data[i+2])
+	}
+	return out
+}
+
+func RemoveColorTransform(data []byte, channels int, t uint8) ([]byte, error) {
+	if t >= numTransforms {
+		return nil, fmt.Errorf("transformada de cor desconhecida: %d", t)
+	}
+	out := make([]byte, len(data))
+	copy(out, data)
+	if t == TRANSFORM_NONE {
+		return out, nil
+	}
+	for i := 0; i+2 < len(out); i += channels {
+		out[i], out[i+1], out[i+2] = inverseColor(t, data[i], data[i+1], data[i+2])
+	}
+	return out, nil
+}
+
+// Aplica cada transformada seguida do filtro numa amostra de linhas e fica
+// com a de menor tamanho estimado. A estimativa passa pelo LZ77: em
+// screenshots a transformada reduz a entropia dos resíduos mas pode quebrar
+// matches longos, e só a entropia de ordem 0 não enxerga isso.
+func chooseColorTransform(data []byte, width, channels int, filter func([]byte, int) []byte) uint8 {
+	sample := sampleImageRows(data, width*channels, transformSampleRows)
+
+	best, bestBits := uint8(TRANSFORM_NONE), -1
+	for t := uint8(0); t < numTransforms; t++ {
+		residuals := filter(ApplyColorTransform(sample, channels, t), width)
+		if bits := EstimateCompressedBits(residuals, true); bestBits < 0 || bits < bestBits {
+			best, bestBits = t, bits
+		}
+	}
+	return best
+}
+
+// Até maxRows linhas, em faixas de 16 linhas consecutivas espalhadas pela
+// imagem (o preditor precisa da linha de cima para ser representativo)
+func sampleImageRows(data []byte, rowSize, maxRows int) []byte {
+	height := len(data) / rowSize
+	if height <= maxRows {
+		return data
+	}
+
+	const band = 16
+	bands := maxRows / band
+	step := height / bands
+	sample := make([]byte, 0, bands*band*rowSize)
+	for i := range bands {
+		start := i * step * rowSize
+		sample = append(sample, data[start:start+band*rowSize]...)
+	}
+	return sample
+}
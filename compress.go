@@ -1,22 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary" // Desnecesario ?
 	"fmt"
 	"io"
+
+	"yoursync/bitio"
 )
 
-// Grava a tabela de frequências no início do ficheiro (OLD)
+// Grava a tabela de frequências no início do ficheiro (OLD). O formato só é
+// lido hoje, pelo DecompressAnyVersion (legacy.go).
 func WriteHeader(w io.Writer, freqs map[byte]int) error {
-	// 1. Escreve quantos caracteres diferentes temos (1 byte)
+	// 1. Escreve quantos caracteres diferentes temos (1 byte; com os 256,
+	// volta a 0)
 	numEntries := uint8(len(freqs))
 
 	if err := binary.Write(w, binary.LittleEndian, numEntries); err != nil {
 		return err
 	}
 
-	// 2. Escreve cada par: [Byte][Frequência]
-	for char, freq := range freqs {
+	// 2. Escreve cada par: [Byte][Frequência], em ordem de byte (a ordem de
+	// um range sobre o mapa muda a cada execução)
+	for c := range 256 {
+		char := byte(c)
+		freq, ok := freqs[char]
+		if !ok {
+			continue
+		}
+
 		// Grava o byte
 		if _, err := w.Write([]byte{char}); err != nil {
 			return err
@@ -32,7 +44,7 @@ func WriteHeader(w io.Writer, freqs map[byte]int) error {
 }
 
 // Percorre a árvore e grava 0 para nós e 1+byte para folhas
-func serializeTree(node *Node, bw *BitWriter) {
+func serializeTree(node *Node, bw *bitio.Writer) {
 	if node.Left == nil && node.Right == nil {
 		bw.WriteBits(1, 1) // Grava o bit '1' indicando que é uma folha
 
@@ -80,7 +92,7 @@ func ReadHeader(r io.Reader) (map[byte]int, error) {
 }
 
 // Inverso para o serializer conseguir reconstruir a folha
-func deserializeTree(br *BitReader) *Node {
+func deserializeTree(br *bitio.Reader) *Node {
 	// Lê 1 bit para saber se é folha ou nó
 	bit, err := br.ReadBits(1)
 	if err != nil {
@@ -101,74 +113,468 @@ func deserializeTree(br *BitReader) *Node {
 	}
 }
 
+// Níveis de compressão, como no gzip: 1 é o mais rápido, 9 o menor
+const (
+	LEVEL_FASTEST = 1
+	LEVEL_DEFAULT = 6
+	LEVEL_BEST    = 9
+
+	// A partir deste nível os streams LZ77 vão em blocos com escolha entre
+	// Huffman e tANS; abaixo fica o stream Huffman único original
+	levelBlocks = 4
+	// Entradas menores que isso ficam sempre no stream único: os 17 bytes
+	// de prefixo do bloco não compensam
+	blockMinInput = 8 << 10
+)
+
+// Opções de compressão além do tipo e da largura
+type Options struct {
+	Meta      *FileMeta // nil = cabeçalho sem seção de metadados
+	Filter    uint8     // FILTER_*, só para imagens de 8 bits
+	Transform uint8     // TRANSFORM_*, só para RGB/RGBA de 8 bits
+	Layout    uint8     // LAYOUT_*, só para imagens de 8 bits com 2+ canais
+	Entropy   uint8     // ENTROPY_*, só para imagens de 8 bits
+	Near      uint8     // Erro máximo por amostra, só para imagens de 8 bits (0 = sem perdas)
+	Level     int       // LEVEL_*; 0 equivale ao comportamento original
+	TileSize  int       // Lado dos tiles de imagens grandes (0 = sem tiles)
+	Previews  bool      // Grava a pirâmide de prévias (só imagens)
+	// Huffman adaptativo (adaptive.go): uma passada só, sem árvores no
+	// arquivo, no lugar dos blocos e do stream estático
+	Adaptive bool
+	// PackBits (rle.go) no lugar de todo o LZ77+Huffman
+	RLE     bool
+	Prepass uint8 // PREPASS_*, só para imagens de 8 bits (padrão PREPASS_NONE)
+}
+
+func DefaultOptions() Options {
+	return Options{Filter: FILTER_ADAPTIVE, Transform: TRANSFORM_AUTO, Layout: LAYOUT_AUTO, Entropy: ENTROPY_AUTO, Level: LEVEL_DEFAULT, TileSize: TILE_SIZE_DEFAULT, Previews: true}
+}
+
 func ViktorCompress(data []byte, dataType uint8, width int, output io.Writer) error {
-	output.Write([]byte{dataType})
+	return ViktorCompressWithOptions(data, dataType, width, DefaultOptions(), output)
+}
 
-	dataToCompress := data
+func ViktorCompressWithOptions(data []byte, dataType uint8, width int, opts Options, output io.Writer) error {
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		return err
+	}
 
-	if dataType == TYPE_IMG {
-		binary.Write(output, binary.LittleEndian, uint32(width))
+	if !kind.IsImage {
+		width = 0
+	} else if width > 0 {
+		if err := kind.checkImageSize(width, len(data)/(width*kind.PixelSize())); err != nil {
+			return err
+		}
+	}
 
-		fmt.Println("Aplicando filtro 2D...")
-		dataToCompress = Apply2DFilterRGB(data, width)
-		return HuffmanCompress(dataToCompress, output, true)
-	} else {
-		binary.Write(output, binary.LittleEndian, uint32(0))
-		return HuffmanCompress(dataToCompress, output, false)
+	header := &Header{DataType: dataType, Width: width, Meta: opts.Meta}
+	if opts.RLE {
+		header.Flags |= FLAG_RLE
+	} else if opts.Adaptive {
+		header.Flags |= FLAG_ADAPTIVE
+	} else if opts.Level >= levelBlocks && len(data) >= blockMinInput {
+		header.Flags |= FLAG_BLOCKS
+	}
+	if kind.IsImage && kind.Depth == 8 {
+		header.Image = resolveImageParams(data, width, kind, opts)
+	}
+	if kind.IsImage && opts.TileSize > 0 && len(data)/kind.PixelSize() >= tileMinPixels {
+		header.TileSize = opts.TileSize
+	}
+	if kind.IsImage && opts.Previews {
+		header.Previews, err = buildPreviews(data, width, kind, opts.Level)
+		if err != nil {
+			return err
+		}
+	}
+	if err := WriteFileHeader(output, header); err != nil {
+		return err
 	}
 
-	//return HuffmanCompress(dataToCompress, output)
+	if header.TileSize > 0 {
+		return compressTiles(data, kind, header, opts, output)
+	}
+	return compressPayload(data, kind, header, opts, output)
 }
 
-func ViktorDecompress(r io.Reader) ([]byte, error) {
-	typeBuf := make([]byte, 1)
-	if _, err := r.Read(typeBuf); err != nil {
-		return nil, err
+// Tudo que vem depois do cabeçalho: pré-processamento e streams de entropia
+func compressPayload(data []byte, kind *PayloadKind, header *Header, opts Options, output io.Writer) error {
+	if header.Image != nil && header.Image.Prepass == PREPASS_RLE {
+		controls, rows, err := rlePackRows(data, header.Width*kind.PixelSize())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Aplicando pré-passo RLE (%s): %d -> %d linhas\n", kind.Name,
+			len(data)/(header.Width*kind.PixelSize()), len(rows)/(header.Width*kind.PixelSize()))
+		if err := binary.Write(output, binary.LittleEndian, uint32(len(controls))); err != nil {
+			return err
+		}
+		if _, err := output.Write(controls); err != nil {
+			return err
+		}
+		data = rows
 	}
 
-	dataType := typeBuf[0]
+	streams, err := preprocessPayload(data, kind, header)
+	if err != nil {
+		return err
+	}
 
-	var width uint32
+	if header.Image != nil && header.Image.Entropy == ENTROPY_CONTEXT {
+		return writeContextCoded(streams[0], kind, header, output)
+	}
+	encode := streamEncoder(header, opts)
+	if len(streams) > 1 {
+		return compressPlanes(streams, encode, output, kind.IsImage)
+	}
+	return encode(streams[0], output, kind.IsImage)
+}
 
-	if dataType == TYPE_IMG {
-		if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
-			return nil, err
+// Backend dos streams, conforme as flags do cabeçalho (backends.go). O
+// nível escolhe o buscador de matches e não vai para o cabeçalho.
+func streamEncoder(header *Header, opts Options) func([]byte, io.Writer, bool) error {
+	encode := HuffmanCompressLevel
+	if backend, _ := lookupBackend(header.Flags); backend != nil {
+		encode = backend.Encode
+	}
+	return func(data []byte, output io.Writer, isImage bool) error {
+		return encode(data, output, isImage, opts.Level)
+	}
+}
+
+// O ReadFileHeader já recusou cabeçalhos com mais de um backend
+func streamDecoder(header *Header) func(io.Reader, int) ([]byte, error) {
+	if backend, _ := lookupBackend(header.Flags); backend != nil {
+		return backend.Decode
+	}
+	return huffmanStreamDecoder(header.Version)
+}
+
+// Cada plano vira um stream Huffman com árvore própria, prefixado pelo seu
+// tamanho comprimido (uint32). O prefixo é necessário porque o bitio.Reader lê
+// adiantado e não pararia sozinho no fim do plano.
+func compressPlanes(planes [][]byte, encode func([]byte, io.Writer, bool) error, output io.Writer, isImage bool) error {
+	for _, plane := range planes {
+		var stream bytes.Buffer
+		if err := encode(plane, &stream, isImage); err != nil {
+			return err
+		}
+		if err := binary.Write(output, binary.LittleEndian, uint32(stream.Len())); err != nil {
+			return err
+		}
+		if _, err := output.Write(stream.Bytes()); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	restored, err := HuffmanDecompress(r)
+func decompressPlanes(r io.Reader, planes int, decode func(io.Reader, int) ([]byte, error)) ([][]byte, error) {
+	data := make([][]byte, 0, planes)
+	for p := range planes {
+		var streamLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &streamLen); err != nil {
+			return nil, fmt.Errorf("plano %d: %w", p, err)
+		}
+		lr := io.LimitReader(r, int64(streamLen))
+		plane, err := decode(lr, -1)
+		if err != nil {
+			return nil, fmt.Errorf("plano %d: %w", p, err)
+		}
+		// O decodificador para no último símbolo útil e pode deixar o fim do
+		// stream (EOF e padding) sem ler
+		io.Copy(io.Discard, lr)
+		data = append(data, plane)
+	}
+	return data, nil
+}
+
+// Lê n bytes de r sem alocar n de antemão: um tamanho corrompido só custa
+// o que o arquivo realmente tem
+func readSized(r io.Reader, n int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, n))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
 
-	if dataType == TYPE_IMG {
-		fmt.Println("Removendo Filtro 2D...")
-		restored = Remove2DFilterRGB(restored, int(width))
+// Divide em n planos de mesmo tamanho (tipos com Planes > 1)
+func splitEqualPlanes(data []byte, n int) [][]byte {
+	if n <= 1 {
+		return [][]byte{data}
+	}
+	size := len(data) / n
+	planes := make([][]byte, n)
+	for p := range n {
+		planes[p] = data[p*size : (p+1)*size]
+	}
+	return planes
+}
+
+func joinEqualPlanes(planes [][]byte) ([]byte, error) {
+	if len(planes) == 1 {
+		return planes[0], nil // Sem cópia: o caso comum, e o maior
+	}
+	for p, plane := range planes {
+		if len(plane) != len(planes[0]) {
+			return nil, fmt.Errorf("plano %d com tamanho %d, esperado %d", p, len(plane), len(planes[0]))
+		}
 	}
+	return bytes.Join(planes, nil), nil
+}
 
-	return restored, nil
+func ViktorDecompress(r io.Reader) ([]byte, error) {
+	restored, _, err := ViktorDecompressWithHeader(r)
+	return restored, err
 }
 
 func ViktorDecompressAndGetMetadata(r io.Reader) ([]byte, uint8, int, error) {
-	typeBuf := make([]byte, 1)
-	if _, err := r.Read(typeBuf); err != nil {
+	restored, header, err := ViktorDecompressWithHeader(r)
+	if err != nil {
 		return nil, 0, 0, err
 	}
-	dataType := typeBuf[0]
+	return restored, header.DataType, header.Width, nil
+}
 
-	var width uint32
-	if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
-		return nil, 0, 0, err
+// Descomprime e devolve o cabeçalho completo (inclusive os metadados do
+// arquivo original, quando gravados)
+func ViktorDecompressWithHeader(r io.Reader) ([]byte, *Header, error) {
+	header, kind, err := readPayloadHeader(r)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	restored, err := HuffmanDecompress(r)
+	restored, err := decompressBody(r, kind, header)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, nil, err
 	}
+	return restored, header, nil
+}
 
-	if dataType == TYPE_IMG {
-		restored = Remove2DFilterRGB(restored, int(width))
+// Tudo depois do cabeçalho, com ou sem tiles
+func decompressBody(r io.Reader, kind *PayloadKind, header *Header) ([]byte, error) {
+	if header.TileSize > 0 {
+		return decompressTiles(r, kind, header)
+	}
+	return decompressPayload(r, kind, header)
+}
+
+func decompressPayload(r io.Reader, kind *PayloadKind, header *Header) ([]byte, error) {
+	var controls []byte
+	if params := header.Image; params != nil {
+		switch params.Prepass {
+		case PREPASS_NONE:
+		case PREPASS_RLE:
+			var n uint32
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+				return nil, fmt.Errorf("pré-passo RLE: %w", err)
+			}
+			var err error
+			if controls, err = readSized(r, int64(n)); err != nil {
+				return nil, fmt.Errorf("pré-passo RLE: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("pré-passo desconhecido: %d", params.Prepass)
+		}
+	}
+
+	var err error
+	var streams [][]byte
+	var data []byte
+	switch n := payloadStreams(kind, header); {
+	case header.Image != nil && header.Image.Entropy == ENTROPY_CONTEXT:
+		data, err = readContextCoded(r, kind, header)
+		streams = [][]byte{data}
+	case header.Image != nil && header.Image.Entropy != ENTROPY_HUFFMAN:
+		err = fmt.Errorf("backend de entropia desconhecido: %d", header.Image.Entropy)
+	case n > 1:
+		streams, err = decompressPlanes(r, n, streamDecoder(header))
+	default:
+		data, err = streamDecoder(header)(r, -1)
+		streams = [][]byte{data}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = postprocessPayload(streams, kind, header)
+	if err != nil || controls == nil {
+		return data, err
+	}
+	return rleUnpackRows(controls, data, header.Width*kind.PixelSize())
+}
+
+// Resolve as opções de imagem (TRANSFORM_AUTO etc.) nos valores que vão para
+// o cabeçalho. nil quando tudo é o padrão original, mantendo o cabeçalho curto.
+func resolveImageParams(data []byte, width int, kind *PayloadKind, opts Options) *ImageParams {
+	params := &ImageParams{Filter: opts.Filter, Transform: opts.Transform, Layout: opts.Layout, Entropy: opts.Entropy, Near: opts.Near, Prepass: opts.Prepass}
+
+	if params.Prepass == PREPASS_AUTO {
+		params.Prepass = chooseRLEPrepass(data, width, kind)
+		fmt.Printf("Pré-passo escolhido: %d\n", params.Prepass)
+	}
+
+	if params.Near > 0 {
+		// A quantização usa seu próprio preditor e o erro só fica limitado
+		// se for medido nos canais originais
+		params.Filter = FILTER_AVERAGE
+		params.Transform = TRANSFORM_NONE
+	}
+
+	if kind.Channels < 3 {
+		params.Transform = TRANSFORM_NONE
+	} else if params.Transform == TRANSFORM_AUTO {
+		params.Transform = chooseColorTransform(data, width, kind.Channels, imageFilterFunc(kind, params))
+		fmt.Printf("Transformada de cor escolhida: %d\n", params.Transform)
+	}
+
+	if kind.Channels < 2 {
+		params.Layout = LAYOUT_INTERLEAVED
+	} else if params.Layout == LAYOUT_AUTO {
+		params.Layout = chooseLayout(data, width, kind, params)
+		fmt.Printf("Disposição escolhida: %d\n", params.Layout)
+	}
+
+	if params.Entropy == ENTROPY_AUTO {
+		params.Entropy = chooseEntropyCoder(data, width, kind, params)
+		fmt.Printf("Backend de entropia escolhido: %d\n", params.Entropy)
+	}
+	if params.Entropy == ENTROPY_CONTEXT {
+		// O range coder modela as linhas do filtro diretamente
+		params.Layout = LAYOUT_INTERLEAVED
+	}
+
+	if *params == (ImageParams{}) {
+		return nil
+	}
+	return params
+}
+
+// O filtro 2D que o pipeline vai usar com estes parâmetros
+func imageFilterFunc(kind *PayloadKind, params *ImageParams) func([]byte, int) []byte {
+	if params.Near > 0 {
+		return func(data []byte, width int) []byte {
+			return ApplyNearLosslessFilter(data, width, kind.Channels, params.Near)
+		}
+	}
+	if params.Filter == FILTER_ADAPTIVE {
+		return func(data []byte, width int) []byte {
+			return ApplyAdaptiveFilter(data, width, kind.Channels)
+		}
+	}
+	return kind.preprocess
+}
+
+// Pipeline antes do LZ77/Huffman: o hook do tipo ou, para imagens com
+// parâmetros no cabeçalho, as etapas escolhidas nas opções. Devolve os
+// streams que viram árvores Huffman separadas (normalmente um só).
+func preprocessPayload(data []byte, kind *PayloadKind, header *Header) ([][]byte, error) {
+	if params := header.Image; params != nil {
+		if params.Transform != TRANSFORM_NONE {
+			data = ApplyColorTransform(data, kind.Channels, params.Transform)
+		}
+		fmt.Printf("Aplicando filtro %d (%s)...\n", params.Filter, kind.Name)
+		data = imageFilterFunc(kind, params)(data, header.Width)
+		if params.Layout == LAYOUT_PLANAR {
+			return splitChannelPlanes(data, header.Width, kind.Channels, params.Filter == FILTER_ADAPTIVE), nil
+		}
+		return [][]byte{data}, nil
+	}
+
+	if kind.Preprocess != nil {
+		fmt.Printf("Aplicando pré-processamento (%s)...\n", kind.Name)
+	}
+	return splitEqualPlanes(kind.preprocess(data, header.Width), kind.Planes), nil
+}
+
+// Quantos streams Huffman o payload tem, segundo o tipo e o cabeçalho
+func payloadStreams(kind *PayloadKind, header *Header) int {
+	if params := header.Image; params != nil && params.Layout == LAYOUT_PLANAR {
+		if params.Filter == FILTER_ADAPTIVE {
+			return kind.Channels + 1
+		}
+		return kind.Channels
+	}
+	return max(kind.Planes, 1)
+}
+
+func postprocessPayload(streams [][]byte, kind *PayloadKind, header *Header) ([]byte, error) {
+	params := header.Image
+	if params == nil {
+		data, err := joinEqualPlanes(streams)
+		if err != nil {
+			return nil, err
+		}
+		return kind.postprocess(data, header.Width), nil
+	}
+
+	var data []byte
+	var err error
+	switch params.Layout {
+	case LAYOUT_INTERLEAVED:
+		data, err = joinEqualPlanes(streams)
+	case LAYOUT_PLANAR:
+		data, err = mergeChannelPlanes(streams, header.Width, kind.Channels, params.Filter == FILTER_ADAPTIVE)
+	default:
+		err = fmt.Errorf("disposição desconhecida: %d", params.Layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case params.Near > 0:
+		data = RemoveNearLosslessFilter(data, header.Width, kind.Channels, params.Near)
+	case params.Filter == FILTER_ADAPTIVE:
+		data, err = RemoveAdaptiveFilter(data, header.Width, kind.Channels)
+	case params.Filter == FILTER_AVERAGE:
+		data = kind.postprocess(data, header.Width)
+	default:
+		err = fmt.Errorf("modo de filtro desconhecido: %d", params.Filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Transform != TRANSFORM_NONE {
+		if kind.Channels < 3 {
+			return nil, fmt.Errorf("transformada de cor em imagem de %d canais", kind.Channels)
+		}
+		return RemoveColorTransform(data, kind.Channels, params.Transform)
+	}
+	return data, nil
+}
+
+func readPayloadHeader(r io.Reader) (*Header, *PayloadKind, error) {
+	header, err := ReadFileHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kind, err := LookupKind(header.DataType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if kind.IsImage && header.Width == 0 {
+		return nil, nil, fmt.Errorf("cabeçalho de imagem com largura zero")
+	}
+	return header, kind, nil
+}
+
+// Descomprime apenas os primeiros `limit` bytes de um payload de texto.
+// Imagens precisam do buffer inteiro para desfazer o filtro 2D.
+func ViktorDecompressPrefix(r io.Reader, limit int) ([]byte, error) {
+	header, kind, err := readPayloadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind.Postprocess != nil {
+		return nil, fmt.Errorf("leitura parcial não suportada para %s", kind.Name)
 	}
 
-	return restored, dataType, int(width), nil
+	return streamDecoder(header)(r, limit)
 }
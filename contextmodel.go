@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Backend de entropia alternativo para imagens de 8 bits: em vez de
+// LZ77+Huffman, cada resíduo do filtro 2D vai direto para o range coder
+// (rangecoder.go), com o contexto tirado dos resíduos vizinhos já
+// codificados. Perto de bordas os resíduos são grandes e em áreas lisas
+// quase sempre zero; separar as estatísticas pela "atividade" local deixa
+// os zeros das áreas lisas custando uma fração de bit.
+const (
+	ENTROPY_HUFFMAN = 0 // LZ77 + Huffman (padrão original)
+	ENTROPY_CONTEXT = 1 // Range coder com modelagem de contexto
+
+	// Não é gravado: escolhe o backend pelo tamanho estimado
+	ENTROPY_AUTO = 0xFF
+)
+
+// Limites de atividade (|a| + |b| + (|c|+|d|)/2) que separam os contextos
+var activityBuckets = []int{0, 1, 2, 4, 6, 10, 16, 26, 42, 70, 120}
+
+// Faixas do resíduo do canal anterior no mesmo pixel
+var crossBuckets = []int{0, 2, 8}
+
+const numCrossContexts = 4
+
+func bucket(limits []int, v int) int {
+	for i, limit := range limits {
+		if v <= limit {
+			return i
+		}
+	}
+	return len(limits)
+}
+
+// Estado do modelo; o codificador e o decodificador evoluem igual porque só
+// olham resíduos já processados
+type residualModel struct {
+	width, channels int
+	rowHeader       bool // Linhas começam com o byte do preditor adaptativo
+	stride          int
+	preds           []uint16
+	samples         []uint16
+}
+
+func newResidualModel(width, channels int, rowHeader bool) *residualModel {
+	m := &residualModel{width: width, channels: channels, rowHeader: rowHeader}
+	m.stride = residualStride(width, channels, rowHeader)
+	contexts := channels * (len(activityBuckets) + 1) * numCrossContexts
+	m.preds = newProbs(rcTreeWidth)
+	m.samples = newProbs(contexts * rcTreeWidth)
+	return m
+}
+
+// Bytes por linha na saída do filtro
+func residualStride(width, channels int, rowHeader bool) int {
+	if rowHeader {
+		return width*channels + 1
+	}
+	return width * channels
+}
+
+func magnitude(v byte) int {
+	return abs(int(int8(v)))
+}
+
+// Árvore de probabilidades do resíduo x da linha y. res guarda as linhas no
+// formato do filtro e só precisa estar preenchido até a posição anterior.
+func (m *residualModel) context(res []byte, y, x int) []uint16 {
+	rowSize := m.width * m.channels
+	row := y * m.stride
+	if m.rowHeader {
+		row++
+	}
+	ch := x % m.channels
+
+	at := func(dy, dx int) int {
+		xx := x + dx*m.channels
+		if y+dy < 0 || xx < 0 || xx >= rowSize {
+			return 0
+		}
+		return magnitude(res[row+dy*m.stride+xx])
+	}
+	activity := at(0, -1) + at(-1, 0) + (at(-1, -1)+at(-1, 1))/2
+
+	cross := 0
+	if ch > 0 {
+		cross = bucket(crossBuckets, magnitude(res[row+x-1])) + 1
+		cross = min(cross, numCrossContexts-1)
+	}
+
+	ctx := (ch*(len(activityBuckets)+1)+bucket(activityBuckets, activity))*numCrossContexts + cross
+	return m.samples[ctx*rcTreeWidth : (ctx+1)*rcTreeWidth]
+}
+
+// zigzag em int8: 0, -1, 1, -2, 2... viram 0, 1, 2, 3, 4...
+func zigzag8(v byte) byte   { return byte(int8(v)<<1) ^ byte(int8(v)>>7) }
+func unzigzag8(v byte) byte { return byte(int8(v>>1) ^ -int8(v&1)) }
+
+func encodeResiduals(res []byte, width, channels int, rowHeader bool) []byte {
+	m := newResidualModel(width, channels, rowHeader)
+	enc := newRangeEncoder()
+	height := len(res) / m.stride
+	rowSize := width * channels
+
+	for y := range height {
+		row := y * m.stride
+		if rowHeader {
+			enc.EncodeByte(m.preds, res[row])
+			row++
+		}
+		for x := range rowSize {
+			enc.EncodeByte(m.context(res, y, x), zigzag8(res[row+x]))
+		}
+	}
+	return enc.Finish()
+}
+
+func decodeResiduals(src []byte, height, width, channels int, rowHeader bool) ([]byte, error) {
+	m := newResidualModel(width, channels, rowHeader)
+	dec := newRangeDecoder(src)
+	res := make([]byte, height*m.stride)
+	rowSize := width * channels
+
+	for y := range height {
+		row := y * m.stride
+		if rowHeader {
+			res[row] = dec.DecodeByte(m.preds)
+			row++
+		}
+		for x := range rowSize {
+			res[row+x] = unzigzag8(dec.DecodeByte(m.context(res, y, x)))
+		}
+	}
+	if dec.Overrun() {
+		return nil, fmt.Errorf("stream do codificador de contexto truncado")
+	}
+	return res, nil
+}
+
+// Formato: [linhas u32][tamanho u32][bytes do range coder]
+func writeContextCoded(res []byte, kind *PayloadKind, header *Header, output io.Writer) error {
+	rowHeader := header.Image.Filter == FILTER_ADAPTIVE
+	coded := encodeResiduals(res, header.Width, kind.Channels, rowHeader)
+	fmt.Printf("[Compress] Codificador de contexto: %d -> %d bytes\n", len(res), len(coded))
+
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], uint32(len(res)/residualStride(header.Width, kind.Channels, rowHeader)))
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(coded)))
+	if _, err := output.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := output.Write(coded)
+	return err
+}
+
+func readContextCoded(r io.Reader, kind *PayloadKind, header *Header) ([]byte, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	height := int(binary.LittleEndian.Uint32(prefix[0:]))
+	if err := kind.checkImageSize(header.Width, height); err != nil {
+		return nil, err
+	}
+	coded, err := readSized(r, int64(binary.LittleEndian.Uint32(prefix[4:])))
+	if err != nil {
+		return nil, fmt.Errorf("stream do codificador de contexto: %w", err)
+	}
+	return decodeResiduals(coded, height, header.Width, kind.Channels, header.Image.Filter == FILTER_ADAPTIVE)
+}
+
+// Compara, na mesma amostra usada pelas outras escolhas automáticas, o
+// tamanho real do range coder com a estimativa do LZ77+Huffman na
+// disposição já escolhida
+func chooseEntropyCoder(data []byte, width int, kind *PayloadKind, params *ImageParams) uint8 {
+	sample := sampleImageRows(data, width*kind.Channels, transformSampleRows)
+	if params.Transform != TRANSFORM_NONE {
+		sample = ApplyColorTransform(sample, kind.Channels, params.Transform)
+	}
+	residuals := imageFilterFunc(kind, params)(sample, width)
+	rowHeader := params.Filter == FILTER_ADAPTIVE
+
+	huffman := 0
+	if params.Layout == LAYOUT_PLANAR {
+		for _, plane := range splitChannelPlanes(residuals, width, kind.Channels, rowHeader) {
+			huffman += EstimateCompressedBits(plane, true) + planePrefixBits
+		}
+	} else {
+		huffman = EstimateCompressedBits(residuals, true)
+	}
+
+	context := len(encodeResiduals(residuals, width, kind.Channels, rowHeader)) * 8
+	if context < huffman {
+		return ENTROPY_CONTEXT
+	}
+	return ENTROPY_HUFFMAN
+}
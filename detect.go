@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"image"
+	"net/http"
+	"strings"
+)
+
+const (
+	detectSampleSize   = 16 << 10 // Tamanho de cada janela de amostragem
+	binaryEntropyLimit = 7.5      // bits/byte: acima disso é aleatório ou já comprimido
+	textControlRatio   = 0.01     // Fração máxima de bytes de controle num texto
+)
+
+// Assinaturas de formatos que não são texto nem imagem decodificável.
+// Formatos já comprimidos não ganham nada com o filtro de imagem nem com o
+// tratamento de texto, então vão direto para o modo genérico.
+var binaryMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	[]byte("PK\x03\x04"),               // zip, jar, docx
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	[]byte("BZh"),                      // bzip2
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("\x7fELF"),                  // executável ELF
+	[]byte("%PDF-"),
+	[]byte(ARCHIVE_MAGIC),
+	[]byte(ARCHIVE_MAGIC_V1),
+}
+
+// Resultado da detecção de conteúdo
+type Detection struct {
+	DataType uint8
+	MIME     string
+	Entropy  float64     // bits/byte estimados pela amostragem
+	Image    image.Image // Preenchido quando o tipo é de imagem
+}
+
+func (d Detection) IsImage() bool {
+	return d.Image != nil
+}
+
+// Descobre o tipo pelo conteúdo, na ordem: assinaturas conhecidas,
+// http.DetectContentType, tentativa de decodificar como imagem e, por fim,
+// entropia e proporção de bytes de controle nas amostras.
+func DetectDataType(data []byte) Detection {
+	if len(data) == 0 {
+		return Detection{DataType: TYPE_TEXT, MIME: "text/plain"}
+	}
+
+	for _, magic := range binaryMagics {
+		if bytes.HasPrefix(data, magic) {
+			return Detection{DataType: TYPE_BINARY, MIME: http.DetectContentType(data), Entropy: sampleEntropy(data)}
+		}
+	}
+
+	mime := http.DetectContentType(data)
+
+	if strings.HasPrefix(mime, "image/") {
+		if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+			return Detection{DataType: ImageKindFor(img), MIME: mime, Image: img}
+		}
+		// Assinatura de imagem, mas decodificador indisponível ou dados ruins
+	}
+
+	det := Detection{DataType: TYPE_BINARY, MIME: mime, Entropy: sampleEntropy(data)}
+	if strings.HasPrefix(mime, "text/") && det.Entropy < binaryEntropyLimit && looksLikeText(data) {
+		det.DataType = detectTextKind(data)
+	}
+	return det
+}
+
+// Refina texto em JSON ou CSV. JSON precisa ser válido por inteiro; CSV só
+// é checado na primeira janela, cortada na última quebra de linha.
+func detectTextKind(data []byte) uint8 {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return TYPE_JSON
+	}
+
+	sample := data[:min(len(data), detectSampleSize)]
+	if len(sample) < len(data) {
+		if cut := bytes.LastIndexByte(sample, '\n'); cut > 0 {
+			sample = sample[:cut+1]
+		}
+	}
+	if looksLikeCSV(sample) {
+		return TYPE_CSV
+	}
+	return TYPE_TEXT
+}
+
+// Pelo menos duas linhas, mais de uma coluna e o mesmo número de colunas em
+// todas (encoding/csv rejeita registros com contagem diferente).
+func looksLikeCSV(sample []byte) bool {
+	for _, sep := range []rune{',', ';', '\t'} {
+		r := csv.NewReader(bytes.NewReader(sample))
+		r.Comma = sep
+
+		records, err := r.ReadAll()
+		if err == nil && len(records) >= 2 && len(records[0]) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Janelas do início, meio e fim: arquivos com cabeçalho de texto e corpo
+// binário (ou o contrário) não enganam a detecção.
+func sampleWindows(data []byte) [][]byte {
+	if len(data) <= 3*detectSampleSize {
+		return [][]byte{data}
+	}
+	mid := len(data)/2 - detectSampleSize/2
+	return [][]byte{
+		data[:detectSampleSize],
+		data[mid : mid+detectSampleSize],
+		data[len(data)-detectSampleSize:],
+	}
+}
+
+// Entropia de Shannon (bits por byte) do histograma das amostras
+func sampleEntropy(data []byte) float64 {
+	var counts [256]int
+	total := 0
+	for _, w := range sampleWindows(data) {
+		for _, b := range w {
+			counts[b]++
+		}
+		total += len(w)
+	}
+
+	// Em ponto fixo, como o EstimateCompressedBits: o tipo detectado decide
+	// o pipeline, então não pode depender do arredondamento da plataforma
+	if total == 0 {
+		return 0
+	}
+	return float64(entropyBitsFixed(counts[:])) / float64(int64(total)<<log2FracBits)
+}
+
+// Texto pode ter \t, \n, \r, \f e ESC (cores ANSI em logs); outros bytes de
+// controle acima de textControlRatio indicam conteúdo binário.
+func looksLikeText(data []byte) bool {
+	control, total := 0, 0
+	for _, w := range sampleWindows(data) {
+		for _, b := range w {
+			if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1b {
+				control++
+			}
+		}
+		total += len(w)
+	}
+	return float64(control) <= float64(total)*textControlRatio
+}
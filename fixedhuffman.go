@@ -0,0 +1,147 @@
+package main
+
+// Modos do stream Huffman (cabeçalho v4), gravados em 2 bits logo depois do
+// tamanho, como o BTYPE do DEFLATE. Para entradas de poucas dezenas de bytes
+// as árvores serializadas podem ser maiores que o próprio payload; o
+// codificador calcula o tamanho dos três modos e grava o menor.
+//
+//	dinâmico: [árvores][códigos]
+//	fixo:     [códigos da tabela fixa]
+//	cru:      [zeros até o fim do byte][bytes originais]
+const (
+	STREAM_DYNAMIC = 0
+	STREAM_FIXED   = 1
+	STREAM_STORED  = 2
+)
+
+// Tabela fixa, a mesma do DEFLATE: literais 0-143 com 8 bits, 144-255 com
+// 9, EOF e comprimentos 256-279 com 7, 280-287 com 8 e as 32 distâncias com
+// 5 bits. Os códigos são canônicos, então não precisam ir no arquivo.
+var fixedTrees = newFixedTrees()
+
+// Tabelas de decodificação dos blocos BLOCK_FIXED
+var fixedTables = [2]*huffTable{newHuffTable(fixedTrees.lit), newHuffTable(fixedTrees.dist)}
+
+func newFixedTrees() *huffmanTrees {
+	var lit [288]uint8
+	for s := range lit {
+		switch {
+		case s < 144:
+			lit[s] = 8
+		case s < 256:
+			lit[s] = 9
+		case s < 280:
+			lit[s] = 7
+		default:
+			lit[s] = 8
+		}
+	}
+	var dist [32]uint8
+	for s := range dist {
+		dist[s] = 5
+	}
+
+	t := &huffmanTrees{}
+	litCodes := canonicalCodes(lit[:])
+	distCodes := canonicalCodes(dist[:])
+	// 286 e 287 existem no DEFLATE mas não no nosso alfabeto
+	copy(t.codes[:286], litCodes)
+	copy(t.codes[300:], distCodes)
+
+	t.lit = treeFromCodes(t.codes[:286], 0)
+	t.dist = treeFromCodes(t.codes[300:], 300)
+	return t
+}
+
+// Códigos canônicos (RFC 1951, 3.2.2): por ordem de comprimento e, dentro do
+// mesmo comprimento, por ordem de símbolo
+func canonicalCodes(lengths []uint8) []huffmanCode {
+	var count [64]int
+	maxLen := uint8(0)
+	for _, l := range lengths {
+		count[l]++
+		maxLen = max(maxLen, l)
+	}
+	count[0] = 0
+
+	var next [64]uint64
+	code := uint64(0)
+	for l := uint8(1); l <= maxLen; l++ {
+		code = (code + uint64(count[l-1])) << 1
+		next[l] = code
+	}
+
+	codes := make([]huffmanCode, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = huffmanCode{bits: next[l], len: l}
+			next[l]++
+		}
+	}
+	return codes
+}
+
+// Monta a árvore de decodificação a partir dos códigos; o símbolo de
+// codes[i] é offset+i
+func treeFromCodes(codes []huffmanCode, offset int) *Node {
+	root := &Node{Symbol: -1}
+	for i, c := range codes {
+		if c.len == 0 {
+			continue
+		}
+		node := root
+		for b := int(c.len) - 1; b >= 0; b-- {
+			next := &node.Left
+			if c.bits>>b&1 == 1 {
+				next = &node.Right
+			}
+			if *next == nil {
+				*next = &Node{Symbol: -1}
+			}
+			node = *next
+		}
+		node.Symbol = offset + i
+	}
+	return root
+}
+
+// Bits que os símbolos custariam com a tabela de códigos de t, sem contar
+// as árvores nem os bits extras
+func (t *huffmanTrees) codeBits(freqs []int) int {
+	bits := 0
+	for s, f := range freqs {
+		bits += f * int(t.codes[s].len)
+	}
+	return bits
+}
+
+// serializeTree: 11 bits por folha e 1 por nó interno
+func serializedTreeBits(freqs []int) int {
+	leaves := 0
+	for _, f := range freqs {
+		if f > 0 {
+			leaves++
+		}
+	}
+	return leaves*11 + max(leaves-1, 0)
+}
+
+// Modo mais barato para os símbolos cujas frequências estão em b, com as
+// árvores dinâmicas já montadas em t. rawBytes é o tamanho original.
+func chooseStreamMode(b *treeBuilder, t *huffmanTrees, rawBytes int) uint8 {
+	dynamic := serializedTreeBits(b.freqs[:300]) + 1 + b.extra + t.codeBits(b.freqs[:])
+	if t.dist != nil {
+		dynamic += serializedTreeBits(b.freqs[300:])
+	}
+	fixed := b.extra + fixedTrees.codeBits(b.freqs[:])
+	stored := 8 * rawBytes // + o alinhamento, no máximo 6 bits
+
+	mode, best := uint8(STREAM_DYNAMIC), dynamic
+	if fixed < best {
+		mode, best = STREAM_FIXED, fixed
+	}
+	if stored+6 < best {
+		mode = STREAM_STORED
+	}
+	return mode
+}
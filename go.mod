@@ -1,3 +1,3 @@
-module main
+module yoursync
 
 go 1.25.5
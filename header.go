@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Cabeçalho do .ys
+//
+//	Tabela de frequências: sem cabeçalho nem LZ77, ver legacy.go
+//	Legado (v1): [type u8][width u32]
+//	v2:          [magic "YS"][version u8][type u8][flags u8][width u32][seções opcionais]
+//	v3:          igual ao v2; os streams Huffman usam árvores separadas para
+//	             literais/comprimentos e distâncias
+//	v4:          igual ao v3; cada stream Huffman grava o modo (árvores
+//	             dinâmicas, tabela fixa ou bytes crus) depois do tamanho
+//	v5:          igual ao v4; FLAG_ADAPTIVE troca os streams por Huffman
+//	             adaptativo (adaptive.go)
+//	v6:          igual ao v5; FLAG_RLE troca os streams por PackBits (rle.go)
+//
+// Os tipos legados vão de 0 a poucas dezenas, então um primeiro byte 'Y' só
+// pode ser o magic do v2. As seções opcionais aparecem na ordem dos bits de
+// flags que as ativam.
+const (
+	HEADER_MAGIC   = "YS"
+	HEADER_VERSION = 6
+
+	// Header.Version dos arquivos no formato de tabela de frequências
+	VERSION_FREQ_TABLE = 0
+
+	FLAG_META     = 1 << 0 // Nome, tamanho, mtime e permissões do arquivo original
+	FLAG_IMAGE    = 1 << 1 // Parâmetros do pipeline de imagem
+	FLAG_BLOCKS   = 1 << 2 // Streams LZ77 em blocos Huffman/tANS (blocks.go), sem seção própria
+	FLAG_TILES    = 1 << 3 // Imagem dividida em tiles independentes (tiles.go): [lado u16]
+	FLAG_PREVIEW  = 1 << 4 // Pirâmide de prévias reduzidas (preview.go)
+	FLAG_ADAPTIVE = 1 << 5 // Streams LZ77 em Huffman adaptativo (adaptive.go), sem seção própria
+	FLAG_RLE      = 1 << 6 // Streams em PackBits (rle.go) no lugar do LZ77+Huffman, sem seção própria
+)
+
+// Modos do filtro 2D
+const (
+	FILTER_AVERAGE  = 0 // Preditor fixo (left+up)/2 do tipo
+	FILTER_ADAPTIVE = 1 // Preditor escolhido por linha (adaptivefilter.go)
+)
+
+type Header struct {
+	Version  uint8
+	DataType uint8
+	Flags    uint8
+	Width    int
+	Meta     *FileMeta
+	Image    *ImageParams
+	TileSize int // 0 = imagem num payload só
+	Previews []Preview
+}
+
+// Parâmetros do pipeline de imagem, gravados como [len u8][campos...]. Campos
+// que não couberem em len valem 0, que é sempre o comportamento original;
+// assim novos campos entram no fim sem quebrar arquivos já gravados.
+type ImageParams struct {
+	Filter    uint8 // FILTER_*
+	Transform uint8 // TRANSFORM_*, aplicada antes do filtro
+	Layout    uint8 // LAYOUT_*, aplicada depois do filtro
+	Entropy   uint8 // ENTROPY_*, no lugar do LZ77+Huffman
+	Near      uint8 // Erro máximo por amostra (0 = sem perdas), ver nearlossless.go
+	Prepass   uint8 // PREPASS_*, antes da transformada e do filtro
+}
+
+// Arquivo com perdas: a imagem volta com erro de até Image.Near por amostra
+func (h *Header) Lossy() bool {
+	return h.Image != nil && h.Image.Near > 0
+}
+
+func (p *ImageParams) marshal() []byte {
+	fields := []byte{p.Filter, p.Transform, p.Layout, p.Entropy, p.Near, p.Prepass}
+	return append([]byte{byte(len(fields))}, fields...)
+}
+
+func readImageParams(r io.Reader) (*ImageParams, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	fields := make([]byte, n[0])
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, err
+	}
+
+	var p ImageParams
+	known := []*uint8{&p.Filter, &p.Transform, &p.Layout, &p.Entropy, &p.Near, &p.Prepass}
+	for i, v := range fields {
+		if i < len(known) {
+			*known[i] = v
+		} else if v != 0 {
+			return nil, fmt.Errorf("parâmetro de imagem %d não suportado por esta versão", i)
+		}
+	}
+	return &p, nil
+}
+
+// Metadados do arquivo original, restaurados pelo decompress
+type FileMeta struct {
+	Name    string // Só o nome base, com extensão
+	Size    uint64
+	ModTime time.Time
+	Mode    fs.FileMode
+}
+
+func FileMetaFromPath(p string) (*FileMeta, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMeta{
+		Name:    info.Name(),
+		Size:    uint64(info.Size()),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().Perm(),
+	}, nil
+}
+
+// Aplica permissões e mtime num arquivo já gravado
+func (m *FileMeta) Apply(p string) error {
+	if err := os.Chmod(p, m.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(p, m.ModTime, m.ModTime)
+}
+
+func WriteFileHeader(w io.Writer, h *Header) error {
+	flags := h.Flags &^ (FLAG_META | FLAG_IMAGE | FLAG_TILES | FLAG_PREVIEW)
+	if h.Meta != nil {
+		flags |= FLAG_META
+	}
+	if h.Image != nil {
+		flags |= FLAG_IMAGE
+	}
+	if h.TileSize > 0 {
+		if h.TileSize > 0xFFFF {
+			return fmt.Errorf("tile grande demais: %d", h.TileSize)
+		}
+		flags |= FLAG_TILES
+	}
+	if len(h.Previews) > 0 {
+		flags |= FLAG_PREVIEW
+	}
+
+	buf := []byte(HEADER_MAGIC)
+	buf = append(buf, HEADER_VERSION, h.DataType, flags)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(h.Width))
+
+	if h.Meta != nil {
+		if len(h.Meta.Name) > 0xFFFF {
+			return fmt.Errorf("nome de arquivo longo demais: %d bytes", len(h.Meta.Name))
+		}
+		// [nameLen u16][name][size u64][mtime i64][mode u32]
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(h.Meta.Name)))
+		buf = append(buf, h.Meta.Name...)
+		buf = binary.LittleEndian.AppendUint64(buf, h.Meta.Size)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(h.Meta.ModTime.UnixNano()))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(h.Meta.Mode))
+	}
+
+	if h.Image != nil {
+		buf = append(buf, h.Image.marshal()...)
+	}
+
+	if h.TileSize > 0 {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(h.TileSize))
+	}
+
+	if len(h.Previews) > 0 {
+		previews, err := marshalPreviews(h.Previews)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, previews...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Lê tanto o cabeçalho v2 quanto o legado
+func ReadFileHeader(r io.Reader) (*Header, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+
+	if first[0] != HEADER_MAGIC[0] {
+		// v1: o primeiro byte já é o tipo
+		var width uint32
+		if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
+			return nil, err
+		}
+		return &Header{Version: 1, DataType: first[0], Width: int(width)}, nil
+	}
+
+	var fixed [1 + 1 + 1 + 1 + 4]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[0] != HEADER_MAGIC[1] {
+		return nil, fmt.Errorf("assinatura .ys inválida")
+	}
+	if fixed[1] > HEADER_VERSION {
+		return nil, fmt.Errorf("versão de cabeçalho %d não suportada (máximo %d)", fixed[1], HEADER_VERSION)
+	}
+
+	h := &Header{
+		Version:  fixed[1],
+		DataType: fixed[2],
+		Flags:    fixed[3],
+		Width:    int(binary.LittleEndian.Uint32(fixed[4:])),
+	}
+	if _, err := lookupBackend(h.Flags); err != nil {
+		return nil, err
+	}
+
+	if h.Flags&FLAG_META != 0 {
+		meta, err := readFileMeta(r)
+		if err != nil {
+			return nil, fmt.Errorf("seção de metadados corrompida: %w", err)
+		}
+		h.Meta = meta
+	}
+
+	if h.Flags&FLAG_IMAGE != 0 {
+		params, err := readImageParams(r)
+		if err != nil {
+			return nil, fmt.Errorf("parâmetros de imagem corrompidos: %w", err)
+		}
+		h.Image = params
+	}
+
+	if h.Flags&FLAG_TILES != 0 {
+		var tileSize uint16
+		if err := binary.Read(r, binary.LittleEndian, &tileSize); err != nil {
+			return nil, fmt.Errorf("seção de tiles corrompida: %w", err)
+		}
+		if tileSize == 0 {
+			return nil, fmt.Errorf("seção de tiles com lado zero")
+		}
+		h.TileSize = int(tileSize)
+	}
+
+	if h.Flags&FLAG_PREVIEW != 0 {
+		previews, err := readPreviews(r)
+		if err != nil {
+			return nil, fmt.Errorf("seção de prévias corrompida: %w", err)
+		}
+		h.Previews = previews
+	}
+
+	return h, nil
+}
+
+func readFileMeta(r io.Reader) (*FileMeta, error) {
+	var nameLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+		return nil, err
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, err
+	}
+
+	var fixed struct {
+		Size    uint64
+		ModTime int64
+		Mode    uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &fixed); err != nil {
+		return nil, err
+	}
+
+	return &FileMeta{
+		Name:    string(name),
+		Size:    fixed.Size,
+		ModTime: time.Unix(0, fixed.ModTime),
+		Mode:    fs.FileMode(fixed.Mode),
+	}, nil
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/bits"
+
+	"yoursync/bitio"
 )
 
 // Arvore
@@ -20,7 +23,11 @@ type PriorityQueue []*Node
 
 func (pq PriorityQueue) Len() int { return len(pq) }
 
-// Menor frequência sai primeiro
+// Menor frequência sai primeiro; no empate, o menor Symbol. Um nó interno
+// leva o menor símbolo das suas folhas, e as folhas de nós diferentes na
+// fila são disjuntas, então dois nós nunca empatam nos dois critérios: a
+// ordem é total e a árvore depende só das frequências, não da ordem em que
+// os nós entraram no heap.
 func (pq PriorityQueue) Less(i, j int) bool {
 	if pq[i].Freq == pq[j].Freq {
 		return pq[i].Symbol < pq[j].Symbol
@@ -42,19 +49,60 @@ func (pq *PriorityQueue) Pop() interface{} {
 	return item
 }
 
+// Árvore de um mapa símbolo -> frequência. O mapa vira um array antes de
+// montar a árvore, então a ordem de iteração dele não chega à saída.
 func BuildTree(frequencies map[int]int) *Node {
-	pq := make(PriorityQueue, 0)
-	heap.Init(&pq)
-
-	// 1. Cria um nó para cada caractere e coloca na fila
+	size := 0
+	for symbol := range frequencies {
+		size = max(size, symbol+1)
+	}
+	freqs := make([]int, size)
 	for symbol, freq := range frequencies {
-		heap.Push(&pq, &Node{Symbol: symbol, Freq: freq})
+		freqs[symbol] = freq
+	}
+
+	var b treeBuilder
+	b.reset(size)
+	return b.build(freqs, 0, size)
+}
+
+// Monta árvores sem alocar a cada chamada: os nós saem de um pool e a fila é
+// reaproveitada. Os ponteiros para os nós valem até o próximo reset.
+type treeBuilder struct {
+	freqs [lz77Alphabet]int
+	extra int // Total de bits extras dos símbolos contados
+	nodes []Node
+	pq    PriorityQueue
+}
+
+// Prepara o pool para árvores com até `symbols` folhas no total
+func (b *treeBuilder) reset(symbols int) {
+	if cap(b.nodes) < 2*symbols {
+		b.nodes = make([]Node, 0, 2*symbols)
+	}
+	b.nodes = b.nodes[:0]
+}
+
+func (b *treeBuilder) newNode(n Node) *Node {
+	b.nodes = append(b.nodes, n)
+	return &b.nodes[len(b.nodes)-1]
+}
+
+// Árvore dos símbolos lo..hi-1 com frequência não nula em freqs
+func (b *treeBuilder) build(freqs []int, lo, hi int) *Node {
+	b.pq = b.pq[:0]
+
+	// 1. Cria um nó para cada símbolo e coloca na fila
+	for symbol := lo; symbol < hi; symbol++ {
+		if freqs[symbol] > 0 {
+			heap.Push(&b.pq, b.newNode(Node{Symbol: symbol, Freq: freqs[symbol]}))
+		}
 	}
 
 	// 2. Enquanto houver mais de um nó, une os dois menores
-	for pq.Len() > 1 {
-		left := heap.Pop(&pq).(*Node)
-		right := heap.Pop(&pq).(*Node)
+	for b.pq.Len() > 1 {
+		left := heap.Pop(&b.pq).(*Node)
+		right := heap.Pop(&b.pq).(*Node)
 
 		if left.Freq == right.Freq && left.Symbol > right.Symbol {
 			left, right = right, left
@@ -63,116 +111,396 @@ func BuildTree(frequencies map[int]int) *Node {
 		minSymbol := min(right.Symbol, left.Symbol)
 
 		// Cria um nó pai com a soma das frequências
-		parent := &Node{
+		parent := b.newNode(Node{
 			Symbol: minSymbol,
 			Freq:   left.Freq + right.Freq,
 			Left:   left,
 			Right:  right,
-		}
-		heap.Push(&pq, parent)
+		})
+		heap.Push(&b.pq, parent)
 	}
 
-	if pq.Len() == 0 {
+	if b.pq.Len() == 0 {
 		return nil
 	}
 
 	// O último nó restante é a raiz da árvore
-	return heap.Pop(&pq).(*Node)
+	return heap.Pop(&b.pq).(*Node)
 }
 
-// Percorre a árvore recursivamente
-func GenerateCodes(node *Node, code string, table map[int]string) {
+// Código Huffman de um símbolo: os `len` bits menos significativos de
+// `bits`, gravados do mais significativo para o menos
+type huffmanCode struct {
+	bits uint64
+	len  uint8
+}
+
+// Percorre a árvore recursivamente preenchendo a tabela de códigos
+func fillCodeTable(node *Node, bits uint64, depth uint8, table []huffmanCode) {
 	if node == nil {
 		return
 	}
 
 	if node.Left == nil && node.Right == nil {
-		table[node.Symbol] = code
+		table[node.Symbol] = huffmanCode{bits: bits, len: depth}
+		return
 	}
 
-	GenerateCodes(node.Left, code+"0", table)
-	GenerateCodes(node.Right, code+"1", table)
+	fillCodeTable(node.Left, bits<<1, depth+1, table)
+	fillCodeTable(node.Right, bits<<1|1, depth+1, table)
 }
 
-func HuffmanCompress(data []byte, output io.Writer, isImage bool) error {
-	lz77Symbols := LZ77Compress(data, isImage)
-	fmt.Printf("[Compress] Símbolos LZ77 gerados: %d\n", len(lz77Symbols))
+// Tamanho aproximado (em bits) que o HuffmanCompress produziria: entropia
+// de ordem 0 de cada alfabeto (literais/comprimentos e distâncias), os bits
+// extras e as árvores serializadas. Não grava nada; serve para comparar
+// variantes de pré-processamento. A conta é toda inteira: com ponto
+// flutuante, um arredondamento diferente (FMA no arm64, por exemplo)
+// poderia trocar a variante escolhida e com ela o arquivo gerado.
+func EstimateCompressedBits(data []byte, isImage bool) int {
+	symbols := LZ77Compress(data, isImage)
+
+	var freqs [lz77Alphabet]int
+	extra := 0
+	for _, s := range symbols {
+		freqs[s.Code()]++
+		extra += s.ExtraBits()
+	}
+
+	bits := extra + 1
+	for _, alphabet := range [][]int{freqs[:300], freqs[300:]} {
+		// serializeTree: 11 bits por folha e 1 por nó interno
+		bits += serializedTreeBits(alphabet) + int(entropyBitsFixed(alphabet)>>log2FracBits)
+	}
+	return bits
+}
+
+// Bits fracionários do log2Fixed
+const log2FracBits = 16
+
+// log2(x) em ponto fixo com log2FracBits bits de fração, só com inteiros
+// (x >= 1). A mantissa é elevada ao quadrado a cada bit: se passar de 2,
+// aquele bit da fração é 1.
+func log2Fixed(x uint64) int64 {
+	n := bits.Len64(x) - 1
+	// Mantissa em [1, 2) com 31 bits de fração
+	m := x << 31 >> n
+	if n > 31 {
+		m = x >> (n - 31)
+	}
+	r := int64(n) << log2FracBits
+	for i := log2FracBits - 1; i >= 0; i-- {
+		m = m * m >> 31
+		if m >= 2<<31 {
+			m >>= 1
+			r |= 1 << i
+		}
+	}
+	return r
+}
 
-	symbolFrequencies := make(map[int]int)
-	for _, symbol := range lz77Symbols {
-		symbolFrequencies[symbol.Code]++
+// Entropia de ordem 0 (em bits, com log2FracBits de fração) de um
+// histograma: a soma de f * log2(total/f)
+func entropyBitsFixed(freqs []int) int64 {
+	total := 0
+	for _, f := range freqs {
+		total += f
+	}
+	if total == 0 {
+		return 0
+	}
+	logTotal := log2Fixed(uint64(total))
+	var sum int64
+	for _, f := range freqs {
+		if f > 0 {
+			sum += int64(f) * (logTotal - log2Fixed(uint64(f)))
+		}
 	}
+	return sum
+}
 
-	root := BuildTree(symbolFrequencies)
-	codes := make(map[int]string)
-	GenerateCodes(root, "", codes)
+// Códigos de distância (300-331) têm árvore própria
+func isDistanceCode(code int) bool {
+	return code >= 300
+}
 
-	binary.Write(output, binary.LittleEndian, uint32(len(data)))
+// Duas árvores, como no DEFLATE: literais, EOF e comprimentos numa,
+// distâncias na outra. Depois de um comprimento o decodificador lê da árvore
+// de distâncias, então os dois alfabetos não disputam os códigos curtos e um
+// "comprimento seguido de literal" nem pode ser representado.
+//
+//	[árvore de literais/comprimentos][1 bit: tem distâncias][árvore de distâncias]
+type huffmanTrees struct {
+	lit, dist *Node
+	codes     [lz77Alphabet]huffmanCode // Os dois alfabetos não se sobrepõem
+}
 
-	bw := NewBitWriter(output)
-	serializeTree(root, bw)
-	//bw.Flush()
+func buildHuffmanTrees(symbols []LZ77Symbol) *huffmanTrees {
+	var b treeBuilder
+	t := &huffmanTrees{}
+	b.buildTrees(symbols, t)
+	return t
+}
 
-	for i, symbol := range lz77Symbols {
-		code, ok := codes[symbol.Code]
-		if !ok {
-			return fmt.Errorf("erro: símbolo %d não possui código huffman", symbol.Code)
-		}
+// Conta as frequências de symbols e monta as duas árvores e a tabela em t
+func (b *treeBuilder) buildTrees(symbols []LZ77Symbol, t *huffmanTrees) {
+	clear(b.freqs[:])
+	b.extra = 0
+	for _, s := range symbols {
+		b.freqs[s.Code()]++
+		b.extra += s.ExtraBits()
+	}
 
-		for _, bitChar := range code {
-			if bitChar == '1' {
-				bw.WriteBits(1, 1)
-			} else {
-				bw.WriteBits(0, 1)
-			}
+	b.reset(lz77Alphabet)
+	t.lit = b.build(b.freqs[:], 0, 300)
+	t.dist = b.build(b.freqs[:], 300, lz77Alphabet)
+	clear(t.codes[:])
+	fillCodeTable(t.lit, 0, 0, t.codes[:])
+	fillCodeTable(t.dist, 0, 0, t.codes[:])
+}
+
+func (t *huffmanTrees) write(bw *bitio.Writer) {
+	serializeTree(t.lit, bw)
+	if t.dist == nil {
+		bw.WriteBits(0, 1)
+		return
+	}
+	bw.WriteBits(1, 1)
+	serializeTree(t.dist, bw)
+}
+
+// Código Huffman do símbolo, na árvore do seu alfabeto, seguido dos bits
+// extras. O símbolo precisa ter entrado nas frequências das árvores.
+func (t *huffmanTrees) writeSymbol(bw *bitio.Writer, s LZ77Symbol) {
+	code := t.codes[s.Code()]
+	bw.WriteBits(code.bits, code.len)
+	if eb := s.ExtraBits(); eb > 0 {
+		bw.WriteBits(uint64(s.ExtraVal()), uint8(eb))
+	}
+}
+
+// Lê as duas árvores e confere os símbolos das folhas uma vez só, em vez de
+// a cada símbolo decodificado
+func readHuffmanTrees(br *bitio.Reader) (*huffmanTrees, error) {
+	t := &huffmanTrees{lit: deserializeTree(br)}
+	if t.lit == nil {
+		return nil, fmt.Errorf("falha ao reconstruir árvore de literais")
+	}
+	hasDist, err := br.ReadBits(1)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao reconstruir árvores: %w", err)
+	}
+	if hasDist == 1 {
+		t.dist = deserializeTree(br)
+		if t.dist == nil {
+			return nil, fmt.Errorf("falha ao reconstruir árvore de distâncias")
 		}
+	}
 
-		if symbol.ExtraBits > 0 {
-			bw.WriteBits(uint64(symbol.ExtraVal), uint8(symbol.ExtraBits))
+	hasLength := false
+	if err := checkTreeSymbols(t.lit, func(s int) bool {
+		hasLength = hasLength || s > 256
+		return s <= 285
+	}); err != nil {
+		return nil, err
+	}
+	if err := checkTreeSymbols(t.dist, func(s int) bool { return s >= 300 && s <= 331 }); err != nil {
+		return nil, err
+	}
+	if hasLength && t.dist == nil {
+		return nil, fmt.Errorf("árvore com comprimentos mas sem árvore de distâncias")
+	}
+	return t, nil
+}
+
+func checkTreeSymbols(node *Node, valid func(int) bool) error {
+	if node == nil {
+		return nil
+	}
+	if node.Left == nil && node.Right == nil {
+		if !valid(node.Symbol) {
+			return fmt.Errorf("símbolo %d fora do alfabeto da árvore", node.Symbol)
 		}
+		return nil
+	}
+	if node.Left == nil || node.Right == nil {
+		return fmt.Errorf("árvore Huffman malformada")
+	}
+	if err := checkTreeSymbols(node.Left, valid); err != nil {
+		return err
+	}
+	return checkTreeSymbols(node.Right, valid)
+}
+
+// Codificador LZ77+Huffman reutilizável. Gera o mesmo stream do
+// HuffmanCompress, mas guarda entre chamadas as tabelas do LZ77, os símbolos,
+// as árvores e o buffer de saída: depois da primeira chamada, comprimir
+// buffers de tamanho parecido não aloca.
+type Encoder struct {
+	bw      *bitio.Writer
+	matcher lz77Matcher
+	symbols []LZ77Symbol
+	builder treeBuilder
+	trees   huffmanTrees
+	mode    uint8   // Modo do último Encode (STREAM_*)
+	size    [4]byte // Fora da pilha escaparia para o heap a cada Encode
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{bw: bitio.NewWriter(w)}
+}
+
+// Escolhe o buscador de matches do nível (matchSettingsForLevel). O
+// padrão, 0, é a cadeia de hash original.
+func (e *Encoder) SetLevel(level int) {
+	e.matcher.settings = matchSettingsForLevel(level)
+}
+
+// Troca o destino mantendo os buffers. Útil para comprimir vários arquivos
+// ou planos com o mesmo Encoder.
+func (e *Encoder) Reset(w io.Writer) {
+	e.bw.Reset(w)
+}
+
+// Comprime data como um stream completo: [tamanho u32][modo 2 bits] e o
+// corpo do modo que ficar menor (fixedhuffman.go)
+func (e *Encoder) Encode(data []byte, isImage bool) error {
+	e.symbols = e.matcher.compress(data, isImage, e.symbols[:0])
+	e.builder.buildTrees(e.symbols, &e.trees)
+	e.mode = chooseStreamMode(&e.builder, &e.trees, len(data))
+
+	binary.LittleEndian.PutUint32(e.size[:], uint32(len(data)))
+	if err := e.bw.WriteBytes(e.size[:]); err != nil {
+		return err
+	}
+	e.bw.WriteBits(uint64(e.mode), 2)
 
-		// Log periódico para não travar o terminal
-		if i%10000 == 0 {
-			fmt.Printf("[Compress] Progresso: %d/%d símbolos processados\n", i, len(lz77Symbols))
+	trees := &e.trees
+	switch e.mode {
+	case STREAM_STORED:
+		if err := e.bw.Align(); err != nil {
+			return err
+		}
+		if err := e.bw.WriteBytes(data); err != nil {
+			return err
 		}
+		return e.bw.Flush()
+	case STREAM_FIXED:
+		trees = fixedTrees
+	default:
+		e.trees.write(e.bw)
 	}
+	for _, s := range e.symbols {
+		trees.writeSymbol(e.bw, s)
+	}
+	return e.bw.Flush()
+}
 
-	fmt.Println("[Compress] Gravação concluída. Fazendo Flush...")
-	return bw.Flush()
+func HuffmanCompress(data []byte, output io.Writer, isImage bool) error {
+	return HuffmanCompressLevel(data, output, isImage, 0)
+}
+
+func HuffmanCompressLevel(data []byte, output io.Writer, isImage bool, level int) error {
+	enc := NewEncoder(output)
+	enc.SetLevel(level)
+	if err := enc.Encode(data, isImage); err != nil {
+		return err
+	}
+	fmt.Printf("[Compress] Símbolos LZ77 gerados: %d\n", len(enc.symbols))
+	return nil
 }
 
 func HuffmanDecompress(r io.Reader) ([]byte, error) {
+	return HuffmanDecompressPrefix(r, -1)
+}
+
+// Igual ao HuffmanDecompress, mas para assim que `limit` bytes estiverem
+// prontos (limit < 0 decodifica tudo). O modo sólido usa isso para ler uma
+// entrada sem decodificar o restante do grupo.
+func HuffmanDecompressPrefix(r io.Reader, limit int) ([]byte, error) {
+	return huffmanDecompress(r, limit, HEADER_VERSION)
+}
+
+// Decodificador dos streams gravados com a versão de cabeçalho `version`:
+// antes da v3 uma árvore só para os dois alfabetos, na v3 árvores separadas
+// sem o modo do stream
+func huffmanStreamDecoder(version uint8) func(io.Reader, int) ([]byte, error) {
+	return func(r io.Reader, limit int) ([]byte, error) {
+		return huffmanDecompress(r, limit, version)
+	}
+}
+
+func huffmanDecompress(r io.Reader, limit int, version uint8) ([]byte, error) {
 	var totalChars uint32
 	if err := binary.Read(r, binary.LittleEndian, &totalChars); err != nil {
 		return nil, err
 	}
 	fmt.Printf("[Decompress] Iniciando. Tamanho esperado: %d bytes\n", totalChars)
 
-	br := newBitReader(r)
-	root := deserializeTree(br)
-	//br.ByteAlign()
-	if root == nil {
-		return nil, fmt.Errorf("falha ao reconstruir árvore")
+	br := bitio.NewReader(r)
+	mode := uint64(STREAM_DYNAMIC)
+	if version >= 4 {
+		var err error
+		if mode, err = br.ReadBits(2); err != nil {
+			return nil, err
+		}
 	}
 
-	result := make([]byte, 0, totalChars)
+	target := totalChars
+	if limit >= 0 && uint32(limit) < totalChars {
+		target = uint32(limit)
+	}
 
-	for uint32(len(result)) < totalChars {
-		symbol := decodeNextSymbol(root, br)
+	singleTree := version < 3
+	var trees *huffmanTrees
+	switch {
+	case mode == STREAM_STORED:
+		result := make([]byte, target)
+		if err := br.ReadAlignedBytes(result); err != nil {
+			return nil, fmt.Errorf("stream cru truncado: %w", err)
+		}
+		fmt.Printf("[Decompress] Sucesso! Total: %d bytes (cru)\n", len(result))
+		return result, nil
+	case mode == STREAM_FIXED:
+		trees = fixedTrees
+	case mode != STREAM_DYNAMIC:
+		return nil, fmt.Errorf("modo de stream desconhecido: %d", mode)
+	case singleTree:
+		root := deserializeTree(br)
+		if root == nil {
+			return nil, fmt.Errorf("falha ao reconstruir árvore")
+		}
+		trees = &huffmanTrees{lit: root, dist: root}
+	default:
+		var err error
+		if trees, err = readHuffmanTrees(br); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]byte, 0, target)
+
+	for uint32(len(result)) < target {
+		symbol := decodeNextSymbol(trees.lit, br)
 
 		if symbol < 256 {
 			result = append(result, byte(symbol))
 		} else if symbol == 256 {
-			fmt.Println("[Decompress] Símbolo EOF (256) encontrado.")
-			break
+			// O tamanho gravado é sempre o do original: um EOF antes dele
+			// (ou o fim dos bits) é stream truncado ou de outro formato
+			return nil, fmt.Errorf("fim do stream na pos %d de %d", len(result), totalChars)
 		} else if symbol >= 257 && symbol <= 285 {
 			baseLen, eBitsL := GetLengthBase(symbol)
 			extraL, _ := br.ReadBits(uint8(eBitsL))
 			finalLen := baseLen + int(extraL)
 
-			distSymbol := decodeNextSymbol(root, br)
+			distSymbol := decodeNextSymbol(trees.dist, br)
 
+			// Na árvore única nada impede um literal aqui; com árvores
+			// separadas só sobra o fim dos bits (decodeNextSymbol devolve 256)
 			if distSymbol < 300 || distSymbol > 331 {
+				if !singleTree {
+					return nil, fmt.Errorf("stream truncado na pos %d", len(result))
+				}
 				return nil, fmt.Errorf("Erro de Sincronia: Lido símbolo %d onde deveria ser uma Distância (300-331) na pos %d", distSymbol, len(result))
 			}
 
@@ -203,16 +531,21 @@ func HuffmanDecompress(r io.Reader) ([]byte, error) {
 		}
 
 		// Log de progresso a cada 20%
-		if len(result) > 0 && len(result)%(int(totalChars)/5) == 0 {
+		if step := int(totalChars) / 5; step > 0 && len(result)%step == 0 {
 			fmt.Printf("[Decompress] %d%% concluído (%d/%d)\n", (len(result)*100)/int(totalChars), len(result), totalChars)
 		}
 	}
 
+	// Um match pode ultrapassar o limite pedido
+	if uint32(len(result)) > target {
+		result = result[:target]
+	}
+
 	fmt.Printf("[Decompress] Sucesso! Total: %d bytes\n", len(result))
 	return result, nil
 }
 
-func decodeNextSymbol(root *Node, br *BitReader) int {
+func decodeNextSymbol(root *Node, br *bitio.Reader) int {
 	curr := root
 	for curr.Left != nil || curr.Right != nil {
 		bit, err := br.ReadBits(1)
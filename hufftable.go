@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+
+	"yoursync/bitio"
+)
+
+// Decodificação por tabela dos blocos Huffman (BLOCK_HUFFMAN_SPLIT e
+// BLOCK_FIXED): os primeiros huffTableBits bits do código indexam a tabela,
+// e o bitio.Cursor recarrega 8 bytes de uma vez
+const huffTableBits = 11 // Bits indexados direto na tabela de decodificação
+
+func isLengthCode(code int) bool {
+	return code >= 257 && code <= 285
+}
+
+// Tabela de decodificação: códigos de até huffTableBits bits saem direto de
+// fast (símbolo | comprimento<<16); os mais longos (ou prefixos sem código)
+// continuam bit a bit a partir do nó em slow
+type huffTable struct {
+	fast [1 << huffTableBits]uint32
+	slow [1 << huffTableBits]*Node
+}
+
+const huffSlowEntry = 1 << 31
+
+func newHuffTable(root *Node) *huffTable {
+	t := &huffTable{}
+	for i := range t.fast {
+		t.fast[i] = huffSlowEntry
+	}
+	t.fill(root, 0, 0)
+	return t
+}
+
+func (t *huffTable) fill(node *Node, prefix int, depth uint8) {
+	if node == nil {
+		return
+	}
+	if node.Left == nil && node.Right == nil {
+		shift := huffTableBits - depth
+		for i := prefix << shift; i < (prefix+1)<<shift; i++ {
+			t.fast[i] = uint32(node.Symbol) | uint32(depth)<<16
+		}
+		return
+	}
+	if depth == huffTableBits {
+		t.slow[prefix] = node
+		return
+	}
+	t.fill(node.Left, prefix<<1, depth+1)
+	t.fill(node.Right, prefix<<1|1, depth+1)
+}
+
+// Códigos com mais de huffTableBits bits; -1 se os bits não formam um código
+func (t *huffTable) decodeSlow(c *bitio.Cursor) int {
+	node := t.slow[c.Peek(huffTableBits)]
+	if node == nil {
+		return -1
+	}
+	c.Skip(huffTableBits)
+	for node.Left != nil {
+		if c.Bits() == 0 {
+			c.Refill()
+		}
+		if c.Peek(1) == 0 {
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+		c.Skip(1)
+	}
+	c.Refill()
+	return node.Symbol
+}
+
+// Como o decodeSlow, mas direto do bitio.Reader: PeekBits escolhe a entrada e
+// SkipBits consome só o comprimento do código
+func (t *huffTable) decodeBits(br *bitio.Reader) (int, error) {
+	peek := br.PeekBits(huffTableBits)
+	if e := t.fast[peek]; e < huffSlowEntry {
+		return int(e & 0xFFFF), br.SkipBits(uint8(e >> 16))
+	}
+	node := t.slow[peek]
+	if node == nil {
+		return -1, fmt.Errorf("código Huffman inválido")
+	}
+	br.SkipBits(huffTableBits)
+	for node.Left != nil {
+		bit, err := br.ReadBits(1)
+		if err != nil {
+			return -1, err
+		}
+		if bit == 0 {
+			node = node.Left
+		} else {
+			node = node.Right
+		}
+	}
+	return node.Symbol, br.Err()
+}
+
+// Por código: bits extras (4 bits baixos) e 1<<4 se o próximo símbolo é uma
+// distância
+var codeInfo = func() (info [lz77Alphabet]uint8) {
+	for code := range info {
+		switch {
+		case isLengthCode(code):
+			_, eb := GetLengthBase(code)
+			info[code] = uint8(eb) | 1<<4
+		case code >= 300:
+			_, eb := GetDistanceBase(code)
+			info[code] = uint8(eb)
+		}
+	}
+	return info
+}()
+
+// Estado da decodificação: o cursor e os símbolos que ele preenche
+type symbolStream struct {
+	c     bitio.Cursor
+	out   []LZ77Symbol
+	i     int
+	table uint8 // 0: literais/comprimentos, 1: distâncias
+}
+
+// Um símbolo do stream; false se os bits não formam um código
+func (s *symbolStream) next(tables *[2]*huffTable) bool {
+	// Com 32 bits no cache o caminho rápido (até 11 + 13 extras) não recarrega
+	s.c.Refill32()
+	t := tables[s.table]
+	var code uint32
+	if e := t.fast[s.c.Peek(huffTableBits)]; e < huffSlowEntry {
+		code = e & 0xFFFF
+		s.c.Skip(uint8(e >> 16))
+	} else if c := t.decodeSlow(&s.c); c >= 0 {
+		code = uint32(c)
+	} else {
+		return false
+	}
+
+	info := codeInfo[code]
+	eb := info & 0xF
+	ev := s.c.Peek(eb)
+	s.c.Skip(eb)
+	s.out[s.i] = LZ77Symbol(code | uint32(eb)<<10 | uint32(ev)<<14)
+	s.i++
+	s.table = info >> 4
+	return true
+}
+
+// Decodifica todos os símbolos e confere que os bits bastaram
+func (s *symbolStream) decodeAll(tables *[2]*huffTable) error {
+	for s.i < len(s.out) {
+		if !s.next(tables) {
+			return fmt.Errorf("código Huffman inválido")
+		}
+	}
+	if s.c.Overrun() {
+		return fmt.Errorf("bloco Huffman truncado")
+	}
+	return nil
+}
+
+// Símbolos de um bloco que começam `skip` bits depois do início de data
+func decodeCursorSymbols(data []byte, skip uint64, tables *[2]*huffTable, count int) ([]LZ77Symbol, error) {
+	if skip > uint64(len(data))*8 {
+		return nil, fmt.Errorf("bloco Huffman truncado")
+	}
+	s := symbolStream{c: bitio.NewCursor(data[skip/8:]), out: make([]LZ77Symbol, count)}
+	s.c.Skip(uint8(skip % 8))
+	if err := s.decodeAll(tables); err != nil {
+		return nil, err
+	}
+	return s.out, nil
+}
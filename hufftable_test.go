@@ -0,0 +1,35 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// Blocos Huffman e da tabela fixa voltam com os mesmos símbolos, e um bloco
+// sem o fim é recusado pelo cursor
+func TestHuffmanBlockRoundTrip(t *testing.T) {
+	decodeFixed := func(payload []byte, count int) ([]LZ77Symbol, error) {
+		return decodeCursorSymbols(payload, 0, &fixedTables, count)
+	}
+	for _, block := range splitBlocks(LZ77CompressLevel(benchInput(), false, LEVEL_DEFAULT)) {
+		for name, c := range map[string]struct {
+			encode func([]LZ77Symbol) []byte
+			decode func([]byte, int) ([]LZ77Symbol, error)
+		}{
+			"árvores": {encodeHuffmanBlock, decodeHuffmanBlock},
+			"fixa":    {encodeFixedBlock, decodeFixed},
+		} {
+			payload := c.encode(block)
+			symbols, err := c.decode(payload, len(block))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !slices.Equal(symbols, block) {
+				t.Fatalf("%s: símbolos diferentes depois do bloco", name)
+			}
+			if _, err := c.decode(payload[:len(payload)-8], len(block)); err == nil {
+				t.Fatalf("%s: bloco truncado aceito", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+)
+
+// Imagens de 16 bits por canal. As amostras ficam em big-endian (como no
+// PNG) e passam por:
+//
+//  1. o mesmo preditor (left+up)/2, calculado sobre uint16;
+//  2. zigzag no resíduo, para que resíduos pequenos negativos (0xFFxx)
+//     também tenham o byte alto zerado;
+//  3. divisão em dois planos: todos os bytes altos, depois todos os baixos.
+//
+// O plano alto é quase todo zero e o baixo carrega o ruído; cada um vira um
+// stream Huffman separado (Planes = 2 no registro de tipos).
+
+func Apply2DFilter16(channels int) func([]byte, int) []byte {
+	return func(data []byte, width int) []byte {
+		return splitBytePlanes(apply2DFilterChannels16(data, width, channels))
+	}
+}
+
+func Remove2DFilter16(channels int) func([]byte, int) []byte {
+	return func(data []byte, width int) []byte {
+		return remove2DFilterChannels16(mergeBytePlanes(data), width, channels)
+	}
+}
+
+func apply2DFilterChannels16(data []byte, width int, channels int) []byte {
+	rowSize := width * channels
+	samples := len(data) / 2
+	filtered := make([]byte, len(data))
+
+	for i := range samples {
+		var left, up uint32
+		if i%rowSize >= channels {
+			left = uint32(binary.BigEndian.Uint16(data[(i-channels)*2:]))
+		}
+		if i >= rowSize {
+			up = uint32(binary.BigEndian.Uint16(data[(i-rowSize)*2:]))
+		}
+
+		prediction := uint16((left + up) / 2)
+		residual := int16(binary.BigEndian.Uint16(data[i*2:]) - prediction)
+		binary.BigEndian.PutUint16(filtered[i*2:], zigzag16(residual))
+	}
+	return filtered
+}
+
+func remove2DFilterChannels16(data []byte, width int, channels int) []byte {
+	rowSize := width * channels
+	samples := len(data) / 2
+	restored := make([]byte, len(data))
+
+	for i := range samples {
+		var left, up uint32
+		if i%rowSize >= channels {
+			left = uint32(binary.BigEndian.Uint16(restored[(i-channels)*2:]))
+		}
+		if i >= rowSize {
+			up = uint32(binary.BigEndian.Uint16(restored[(i-rowSize)*2:]))
+		}
+
+		prediction := uint16((left + up) / 2)
+		residual := unzigzag16(binary.BigEndian.Uint16(data[i*2:]))
+		binary.BigEndian.PutUint16(restored[i*2:], uint16(residual)+prediction)
+	}
+	return restored
+}
+
+func zigzag16(v int16) uint16 {
+	return uint16(v<<1) ^ uint16(v>>15)
+}
+
+func unzigzag16(v uint16) int16 {
+	return int16(v>>1) ^ -int16(v&1)
+}
+
+// [hi0 lo0 hi1 lo1 ...] -> [hi0 hi1 ...][lo0 lo1 ...]
+func splitBytePlanes(data []byte) []byte {
+	n := len(data) / 2
+	planes := make([]byte, len(data))
+	for i := range n {
+		planes[i] = data[i*2]
+		planes[n+i] = data[i*2+1]
+	}
+	return planes
+}
+
+func mergeBytePlanes(planes []byte) []byte {
+	n := len(planes) / 2
+	data := make([]byte, len(planes))
+	for i := range n {
+		data[i*2] = planes[i]
+		data[i*2+1] = planes[n+i]
+	}
+	return data
+}
+
+// Escolhe entre os modos de 16 bits. Só é chamado para imagens cujo tipo Go
+// já é de 16 bits (Gray16, NRGBA64, RGBA64).
+func imageKindFor16(img image.Image) uint8 {
+	if _, ok := img.(*image.Gray16); ok {
+		return TYPE_IMG_GRAY16
+	}
+
+	gray, opaque := true, true
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y && (gray || opaque); y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			if c.R != c.G || c.G != c.B {
+				gray = false
+			}
+			if c.A != 0xFFFF {
+				opaque = false
+			}
+		}
+	}
+
+	switch {
+	case gray && opaque:
+		return TYPE_IMG_GRAY16
+	case opaque:
+		return TYPE_IMG_RGB16
+	}
+	// Cinza+alpha de 16 bits não tem modo próprio e usa RGBA16
+	return TYPE_IMG_RGBA16
+}
+
+func is16BitImage(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray16, *image.NRGBA64, *image.RGBA64:
+		return true
+	}
+	return false
+}
+
+func imageToGray16Bytes(img image.Image) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	data := make([]byte, width*height*2)
+
+	if gray, ok := img.(*image.Gray16); ok {
+		for y := range height {
+			copy(data[y*width*2:(y+1)*width*2], gray.Pix[y*gray.Stride:])
+		}
+		return data
+	}
+
+	for y := range height {
+		for x := range width {
+			c := color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+			binary.BigEndian.PutUint16(data[(y*width+x)*2:], c.Y)
+		}
+	}
+	return data
+}
+
+// channels = 3 descarta o alpha (só usado quando a imagem é opaca)
+func imageToNRGBA64Bytes(channels int) func(image.Image) []byte {
+	return func(img image.Image) []byte {
+		bounds := img.Bounds()
+		width, height := bounds.Dx(), bounds.Dy()
+		data := make([]byte, width*height*channels*2)
+
+		for y := range height {
+			for x := range width {
+				c := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+				pos := (y*width + x) * channels * 2
+				binary.BigEndian.PutUint16(data[pos:], c.R)
+				binary.BigEndian.PutUint16(data[pos+2:], c.G)
+				binary.BigEndian.PutUint16(data[pos+4:], c.B)
+				if channels == 4 {
+					binary.BigEndian.PutUint16(data[pos+6:], c.A)
+				}
+			}
+		}
+		return data
+	}
+}
+
+func buildGray16ImageObject(data []byte, width int) image.Image {
+	height := len(data) / (width * 2)
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	copy(img.Pix, data)
+	return img
+}
+
+func buildNRGBA64ImageObject(channels int) func([]byte, int) image.Image {
+	return func(data []byte, width int) image.Image {
+		height := len(data) / (width * channels * 2)
+		img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+
+		if channels == 4 {
+			copy(img.Pix, data)
+			return img
+		}
+
+		for i := 0; i < width*height; i++ {
+			copy(img.Pix[i*8:i*8+6], data[i*6:i*6+6])
+			img.Pix[i*8+6] = 0xFF // A (opaco)
+			img.Pix[i*8+7] = 0xFF
+		}
+		return img
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// Um tipo de payload conhecido pelo motor. O byte de tipo gravado no
+// cabeçalho é o ID do tipo; compressão, descompressão, viewer e CLI consultam
+// este registro em vez de comparar com TYPE_* espalhados pelo código.
+type PayloadKind struct {
+	ID        uint8
+	Name      string // Exibido no CLI e no viewer
+	Extension string // Extensão usada quando o nome original não é conhecido
+	IsImage   bool   // Usa o minMatch de imagem no LZ77
+	Channels  int    // Amostras por pixel (só imagens)
+	Depth     int    // Bits por amostra (8 ou 16, só imagens)
+
+	// Quantos planos de mesmo tamanho o resultado do Preprocess tem. Cada
+	// plano vira um stream Huffman independente (0 ou 1 = stream único).
+	Planes int
+
+	// Imagem decodificada -> bytes crus do payload, e o caminho inverso
+	FromImage func(img image.Image) []byte
+	ToImage   func(data []byte, width int) image.Image
+
+	// Transformação aplicada antes do LZ77/Huffman e desfeita depois (nil = nenhuma)
+	Preprocess  func(data []byte, width int) []byte
+	Postprocess func(data []byte, width int) []byte
+
+	// Grava os dados restaurados no formato original
+	Reconstruct func(w io.Writer, data []byte, width int) error
+}
+
+const (
+	TYPE_CSV            = 3
+	TYPE_JSON           = 4
+	TYPE_IMG_GRAY       = 5
+	TYPE_IMG_RGBA       = 6
+	TYPE_IMG_GRAY_ALPHA = 7
+	TYPE_IMG_GRAY16     = 8
+	TYPE_IMG_RGB16      = 9
+	TYPE_IMG_RGBA16     = 10
+	TYPE_IMG_RGB        = TYPE_IMG // Nome explícito para o TYPE_IMG original
+)
+
+var payloadKinds = []*PayloadKind{
+	{ID: TYPE_TEXT, Name: "TEXTO", Extension: ".txt", Reconstruct: writeRaw},
+	{ID: TYPE_CSV, Name: "CSV", Extension: ".csv", Reconstruct: writeRaw},
+	{ID: TYPE_JSON, Name: "JSON", Extension: ".json", Reconstruct: writeRaw},
+	{ID: TYPE_BINARY, Name: "BINÁRIO", Extension: ".bin", Reconstruct: writeRaw},
+	{
+		ID: TYPE_IMG_RGB, Name: "IMAGEM", Extension: ".png", IsImage: true, Channels: 3, Depth: 8,
+		FromImage:   imageToRGBBytes,
+		ToImage:     buildImageObject,
+		Preprocess:  Apply2DFilterRGB,
+		Postprocess: Remove2DFilterRGB,
+		Reconstruct: pngReconstructor(buildImageObject),
+	},
+	{
+		ID: TYPE_IMG_GRAY, Name: "IMAGEM CINZA", Extension: ".png", IsImage: true, Channels: 1, Depth: 8,
+		FromImage:   imageToGrayscaleBytes,
+		ToImage:     buildGrayImageObject,
+		Preprocess:  Apply2DFilter,
+		Postprocess: Remove2DFilter,
+		Reconstruct: pngReconstructor(buildGrayImageObject),
+	},
+	{
+		ID: TYPE_IMG_GRAY_ALPHA, Name: "IMAGEM CINZA+ALPHA", Extension: ".png", IsImage: true, Channels: 2, Depth: 8,
+		FromImage:   imageToGrayAlphaBytes,
+		ToImage:     buildGrayAlphaImageObject,
+		Preprocess:  Apply2DFilterGrayAlpha,
+		Postprocess: Remove2DFilterGrayAlpha,
+		Reconstruct: pngReconstructor(buildGrayAlphaImageObject),
+	},
+	{
+		ID: TYPE_IMG_RGBA, Name: "IMAGEM RGBA", Extension: ".png", IsImage: true, Channels: 4, Depth: 8,
+		FromImage:   imageToRGBABytes,
+		ToImage:     buildRGBAImageObject,
+		Preprocess:  Apply2DFilterRGBA,
+		Postprocess: Remove2DFilterRGBA,
+		Reconstruct: pngReconstructor(buildRGBAImageObject),
+	},
+	{
+		ID: TYPE_IMG_GRAY16, Name: "IMAGEM CINZA 16", Extension: ".png", IsImage: true, Channels: 1, Depth: 16, Planes: 2,
+		FromImage:   imageToGray16Bytes,
+		ToImage:     buildGray16ImageObject,
+		Preprocess:  Apply2DFilter16(1),
+		Postprocess: Remove2DFilter16(1),
+		Reconstruct: pngReconstructor(buildGray16ImageObject),
+	},
+	{
+		ID: TYPE_IMG_RGB16, Name: "IMAGEM RGB 16", Extension: ".png", IsImage: true, Channels: 3, Depth: 16, Planes: 2,
+		FromImage:   imageToNRGBA64Bytes(3),
+		ToImage:     buildNRGBA64ImageObject(3),
+		Preprocess:  Apply2DFilter16(3),
+		Postprocess: Remove2DFilter16(3),
+		Reconstruct: pngReconstructor(buildNRGBA64ImageObject(3)),
+	},
+	{
+		ID: TYPE_IMG_RGBA16, Name: "IMAGEM RGBA 16", Extension: ".png", IsImage: true, Channels: 4, Depth: 16, Planes: 2,
+		FromImage:   imageToNRGBA64Bytes(4),
+		ToImage:     buildNRGBA64ImageObject(4),
+		Preprocess:  Apply2DFilter16(4),
+		Postprocess: Remove2DFilter16(4),
+		Reconstruct: pngReconstructor(buildNRGBA64ImageObject(4)),
+	},
+}
+
+func LookupKind(id uint8) (*PayloadKind, error) {
+	for _, k := range payloadKinds {
+		if k.ID == id {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("tipo de payload desconhecido: %d", id)
+}
+
+func writeRaw(w io.Writer, data []byte, width int) error {
+	_, err := w.Write(data)
+	return err
+}
+
+func pngReconstructor(toImage func([]byte, int) image.Image) func(io.Writer, []byte, int) error {
+	return func(w io.Writer, data []byte, width int) error {
+		return png.Encode(w, toImage(data, width))
+	}
+}
+
+// Bytes por pixel no payload cru (só imagens)
+func (k *PayloadKind) PixelSize() int {
+	return k.Channels * k.Depth / 8
+}
+
+// Teto do payload cru de uma imagem. Nos tiles e no codificador de contexto
+// a altura vem de um u32 do arquivo, e sem o teto um .ys corrompido de
+// poucos bytes pediria gigabytes antes de qualquer byte do payload ser
+// conferido. O compress recusa imagens maiores, então todo arquivo gravado
+// continua legível.
+const MAX_IMAGE_BYTES = 1 << 30
+
+// Erro se width×height pixels do tipo passam de MAX_IMAGE_BYTES
+func (k *PayloadKind) checkImageSize(width, height int) error {
+	if width > 0 && height > MAX_IMAGE_BYTES/k.PixelSize()/width {
+		return fmt.Errorf("imagem de %dx%d passa do limite de %d MiB", width, height, MAX_IMAGE_BYTES>>20)
+	}
+	return nil
+}
+
+func (k *PayloadKind) preprocess(data []byte, width int) []byte {
+	if k.Preprocess == nil {
+		return data
+	}
+	return k.Preprocess(data, width)
+}
+
+func (k *PayloadKind) postprocess(data []byte, width int) []byte {
+	if k.Postprocess == nil {
+		return data
+	}
+	return k.Postprocess(data, width)
+}
@@ -0,0 +1,114 @@
+package main
+
+import "fmt"
+
+// Disposição dos resíduos de imagem antes do LZ77. No modo intercalado
+// (RGBRGB...) um match precisa casar todos os canais ao mesmo tempo; no modo
+// planar (RRR...GGG...BBB...) cada canal vira um stream Huffman separado, com
+// árvore e matches próprios. Com o filtro adaptativo os bytes de preditor de
+// cada linha formam um plano extra, gravado antes dos canais.
+const (
+	LAYOUT_INTERLEAVED = 0
+	LAYOUT_PLANAR      = 1
+
+	// Não é gravado: escolhe a disposição pelo tamanho estimado
+	LAYOUT_AUTO = 0xFF
+)
+
+// Bits do prefixo de tamanho de cada plano (compressPlanes)
+const planePrefixBits = 32
+
+// rowHeader indica que cada linha começa com um byte de preditor
+// (saída de ApplyAdaptiveFilter)
+func splitChannelPlanes(data []byte, width, channels int, rowHeader bool) [][]byte {
+	rowSize := width * channels
+	stride := rowSize
+	if rowHeader {
+		stride++
+	}
+	height := len(data) / stride
+
+	planes := make([][]byte, 0, channels+1)
+	if rowHeader {
+		preds := make([]byte, height)
+		for y := range height {
+			preds[y] = data[y*stride]
+		}
+		planes = append(planes, preds)
+	}
+
+	start := stride - rowSize
+	for ch := range channels {
+		plane := make([]byte, 0, width*height)
+		for y := range height {
+			row := data[y*stride+start : (y+1)*stride]
+			for x := ch; x < rowSize; x += channels {
+				plane = append(plane, row[x])
+			}
+		}
+		planes = append(planes, plane)
+	}
+	return planes
+}
+
+func mergeChannelPlanes(planes [][]byte, width, channels int, rowHeader bool) ([]byte, error) {
+	first := 0
+	if rowHeader {
+		first = 1
+	}
+	if len(planes) != channels+first {
+		return nil, fmt.Errorf("disposição planar: %d planos, esperado %d", len(planes), channels+first)
+	}
+
+	pixels := len(planes[first])
+	if pixels%width != 0 {
+		return nil, fmt.Errorf("disposição planar: %d pixels não formam linhas de %d", pixels, width)
+	}
+	height := pixels / width
+	for i, p := range planes[first:] {
+		if len(p) != pixels {
+			return nil, fmt.Errorf("plano %d com tamanho %d, esperado %d", first+i, len(p), pixels)
+		}
+	}
+	if rowHeader && len(planes[0]) != height {
+		return nil, fmt.Errorf("plano de preditores com %d linhas, esperado %d", len(planes[0]), height)
+	}
+
+	rowSize := width * channels
+	stride := rowSize + first
+	data := make([]byte, height*stride)
+	for y := range height {
+		if rowHeader {
+			data[y*stride] = planes[0][y]
+		}
+		row := data[y*stride+first : (y+1)*stride]
+		for x := range width {
+			for ch := range channels {
+				row[x*channels+ch] = planes[first+ch][y*width+x]
+			}
+		}
+	}
+	return data, nil
+}
+
+// Compara, numa amostra de linhas já transformada e filtrada, o tamanho
+// estimado do stream intercalado com a soma dos planos (cada um pagando sua
+// própria árvore e prefixo de tamanho)
+func chooseLayout(data []byte, width int, kind *PayloadKind, params *ImageParams) uint8 {
+	sample := sampleImageRows(data, width*kind.Channels, transformSampleRows)
+	if params.Transform != TRANSFORM_NONE {
+		sample = ApplyColorTransform(sample, kind.Channels, params.Transform)
+	}
+	residuals := imageFilterFunc(kind, params)(sample, width)
+
+	interleaved := EstimateCompressedBits(residuals, true)
+	planar := 0
+	for _, plane := range splitChannelPlanes(residuals, width, kind.Channels, params.Filter == FILTER_ADAPTIVE) {
+		planar += EstimateCompressedBits(plane, true) + planePrefixBits
+	}
+
+	if planar < interleaved {
+		return LAYOUT_PLANAR
+	}
+	return LAYOUT_INTERLEAVED
+}
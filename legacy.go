@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"yoursync/bitio"
+)
+
+// Formato de tabela de frequências ("OLD", WriteHeader/ReadHeader em
+// compress.go), anterior ao cabeçalho v1:
+//
+//	[entradas u8][byte u8][freq u32]...[códigos Huffman dos bytes]
+//
+// Não tem LZ77, tipo nem largura: os códigos são os dos próprios bytes do
+// original, MSB primeiro, com zeros até o fim do último byte. A árvore não é
+// gravada; sai das frequências pelo BuildTree (0 = filho esquerdo). Com os
+// 256 bytes presentes o contador de 1 byte volta a 0.
+//
+// Também não tem assinatura, então o formato é reconhecido pela estrutura:
+// bytes distintos, frequências não nulas e o arquivo terminando exatamente
+// onde terminam os códigos. Uma tabela pode começar com o magic "YS" (89
+// entradas, a primeira do byte 'S') e até com um byte de versão válido; veja
+// hasHeader.
+const freqTableEntrySize = 5
+
+// Separa a tabela dos códigos; ok = false se data não tem a estrutura do
+// formato
+func parseFreqTable(data []byte) (freqs map[byte]int, body []byte, ok bool) {
+	freqs, body, ok = parseFreqEntries(data)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var codes [256]huffmanCode
+	fillCodeTable(freqTableTree(freqs), 0, 0, codes[:])
+	bits := 0
+	for b, f := range freqs {
+		bits += f * int(codes[b].len)
+	}
+	if len(body) != (bits+7)/8 {
+		return nil, nil, false
+	}
+	// O preenchimento do último byte é sempre zero
+	if pad := -bits & 7; pad > 0 && body[len(body)-1]&(1<<pad-1) != 0 {
+		return nil, nil, false
+	}
+	return freqs, body, true
+}
+
+// Só a tabela: confere a contagem, bytes distintos e frequências não nulas,
+// sem olhar o tamanho dos códigos
+func parseFreqEntries(data []byte) (freqs map[byte]int, body []byte, ok bool) {
+	if len(data) == 0 {
+		return nil, nil, false
+	}
+	entries := int(data[0])
+	if entries == 0 && len(data) > 1 {
+		entries = 256
+	}
+	table := data[1:]
+	if len(table) < entries*freqTableEntrySize {
+		return nil, nil, false
+	}
+
+	freqs = make(map[byte]int, entries)
+	for i := range entries {
+		e := table[i*freqTableEntrySize:]
+		freq := binary.LittleEndian.Uint32(e[1:])
+		if _, dup := freqs[e[0]]; dup || freq == 0 {
+			return nil, nil, false
+		}
+		freqs[e[0]] = int(freq)
+	}
+	return freqs, table[entries*freqTableEntrySize:], true
+}
+
+func freqTableTree(freqs map[byte]int) *Node {
+	symbols := make(map[int]int, len(freqs))
+	for b, f := range freqs {
+		symbols[int(b)] = f
+	}
+	return BuildTree(symbols)
+}
+
+func decodeFreqTable(freqs map[byte]int, body []byte) ([]byte, error) {
+	total := 0
+	for _, f := range freqs {
+		total += f
+	}
+	if total == 0 {
+		return []byte{}, nil
+	}
+
+	// Com um byte só a raiz é folha e os códigos têm 0 bits
+	table := newHuffTable(freqTableTree(freqs))
+	br := bitio.NewReader(bytes.NewReader(body))
+	restored := make([]byte, total)
+	for i := range restored {
+		s, err := table.decodeBits(br)
+		if err != nil {
+			return nil, fmt.Errorf("byte %d: %w", i, err)
+		}
+		restored[i] = byte(s)
+	}
+	return restored, nil
+}
+
+// Versão do formato de data: VERSION_FREQ_TABLE, 1 (cabeçalho legado) ou a
+// versão gravada no cabeçalho. Com o magic mas sem um cabeçalho válido nem a
+// tabela, devolve o byte de versão como está (pode passar de HEADER_VERSION)
+func formatVersion(data []byte) uint8 {
+	if hasHeader(data) {
+		return data[2]
+	}
+	if _, _, ok := parseFreqTable(data); ok {
+		return VERSION_FREQ_TABLE
+	}
+	if hasHeaderMagic(data) && data[2] >= 2 {
+		return data[2]
+	}
+	return 1
+}
+
+// Começa com o magic do cabeçalho v2+ (e tem o byte de versão)
+func hasHeaderMagic(data []byte) bool {
+	return len(data) >= 3 && string(data[:2]) == HEADER_MAGIC
+}
+
+func hasHeaderVersion(data []byte) bool {
+	return hasHeaderMagic(data) && data[2] >= 2 && data[2] <= HEADER_VERSION
+}
+
+// Uma tabela de frequências também pode começar com "YS", então o magic só
+// vale com uma versão conhecida e um cabeçalho que pode ser lido inteiro. Se
+// a heurística também reconhece a tabela, decide a decodificação do payload.
+func hasHeader(data []byte) bool {
+	if !hasHeaderVersion(data) {
+		return false
+	}
+	if _, _, err := readPayloadHeader(bytes.NewReader(data)); err != nil {
+		return false
+	}
+	if _, _, ok := parseFreqTable(data); !ok {
+		return true
+	}
+	_, _, err := ViktorDecompressWithHeader(bytes.NewReader(data))
+	return err == nil
+}
+
+func formatName(version uint8) string {
+	if version == VERSION_FREQ_TABLE {
+		return "tabela de frequências"
+	}
+	return fmt.Sprintf("v%d", version)
+}
+
+// Descomprime qualquer versão: a tabela de frequências e os cabeçalhos de v1
+// até HEADER_VERSION. Recebe o arquivo inteiro porque o formato de tabela de
+// frequências só é reconhecido pelo tamanho.
+func DecompressAnyVersion(data []byte) ([]byte, *Header, error) {
+	if hasHeader(data) {
+		return ViktorDecompressWithHeader(bytes.NewReader(data))
+	}
+	freqs, body, ok := parseFreqTable(data)
+	if !ok {
+		return ViktorDecompressWithHeader(bytes.NewReader(data))
+	}
+
+	restored, err := decodeFreqTable(freqs, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("formato de tabela de frequências: %w", err)
+	}
+	fmt.Printf("[Decompress] Formato de tabela de frequências: %d bytes\n", len(restored))
+	return restored, &Header{Version: VERSION_FREQ_TABLE, DataType: legacyDataType(restored)}, nil
+}
+
+// Como o DecompressAnyVersion, lendo de r: com o magic e uma versão
+// conhecida o payload é decodificado direto do reader. Os outros arquivos
+// (tabela de frequências e v1) precisam do tamanho total e são lidos
+// inteiros, assim como os raros v2+ cujo início também tem a forma da tabela.
+func DecompressAnyVersionFrom(r io.Reader) ([]byte, *Header, error) {
+	br := bufio.NewReader(r)
+	// Com o magic, o primeiro byte ('Y') seria a contagem de entradas
+	head, _ := br.Peek(1 + int(HEADER_MAGIC[0])*freqTableEntrySize)
+	if hasHeaderVersion(head) {
+		if _, _, ok := parseFreqEntries(head); !ok {
+			return ViktorDecompressWithHeader(br)
+		}
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return DecompressAnyVersion(data)
+}
+
+// O formato antigo guarda os bytes do arquivo como estão, inclusive os de
+// imagens codificadas: elas continuam como binário para voltarem idênticas
+func legacyDataType(data []byte) uint8 {
+	det := DetectDataType(data)
+	if det.IsImage() {
+		return TYPE_BINARY
+	}
+	return det.DataType
+}
+
+// upgrade <arquivo|diretório>: regrava no formato atual os arquivos na
+// tabela de frequências ou com o cabeçalho v1. Num diretório, percorre os
+// .ys recursivamente. Arquivos v2 em diante já são lidos pelo formato atual
+// e ficam como estão.
+func execUpgrade(target string) {
+	info, err := os.Stat(target)
+	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+
+	paths := []string{target}
+	if info.IsDir() {
+		paths = nil
+		err = filepath.WalkDir(target, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && strings.HasSuffix(d.Name(), ".ys") {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Erro ao percorrer o diretório:", err)
+			return
+		}
+	}
+
+	upgraded, failed := 0, 0
+	for _, p := range paths {
+		from, err := upgradeFile(p)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("%s: erro: %v\n", p, err)
+		case from >= 2:
+			fmt.Printf("%s: já está no formato atual (v%d)\n", p, from)
+		default:
+			upgraded++
+			fmt.Printf("%s: %s -> v%d\n", p, formatName(from), HEADER_VERSION)
+		}
+	}
+	fmt.Printf("Atualizados: %d, com erro: %d, de %d arquivos\n", upgraded, failed, len(paths))
+}
+
+// Regrava p no formato atual se for anterior ao v2 e devolve a versão de
+// antes. O novo arquivo é descomprimido e comparado com o conteúdo antigo
+// antes de substituir o original, que só é trocado por rename.
+func upgradeFile(p string) (uint8, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return 0, err
+	}
+	from := formatVersion(data)
+	if from > HEADER_VERSION {
+		return from, fmt.Errorf("versão de cabeçalho %d não suportada (máximo %d)", from, HEADER_VERSION)
+	}
+	if from >= 2 {
+		return from, nil
+	}
+
+	restored, header, err := DecompressAnyVersion(data)
+	if err != nil {
+		return from, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return from, err
+	}
+	opts := DefaultOptions()
+	opts.Meta = &FileMeta{
+		Name:    strings.TrimSuffix(info.Name(), ".ys"),
+		Size:    uint64(len(restored)),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().Perm(),
+	}
+	var out bytes.Buffer
+	if err := ViktorCompressWithOptions(restored, header.DataType, header.Width, opts, &out); err != nil {
+		return from, err
+	}
+
+	check, err := ViktorDecompress(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		return from, fmt.Errorf("verificação: %w", err)
+	}
+	if !bytes.Equal(check, restored) {
+		return from, fmt.Errorf("verificação: o arquivo novo não devolve o conteúdo original")
+	}
+
+	return from, replaceFile(p, out.Bytes(), info)
+}
+
+// Troca p pelo conteúdo novo via temporário, mantendo permissões e mtime
+// do original
+func replaceFile(p string, data []byte, info fs.FileInfo) error {
+	return writeAndRename(p, info.Mode().Perm(), info.ModTime(), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"yoursync/bitio"
+)
+
+// Arquivo no formato de tabela de frequências, como o compressor antigo
+// gravava
+func freqTableFile(t *testing.T, data []byte) []byte {
+	freqs := map[byte]int{}
+	for _, b := range data {
+		freqs[b]++
+	}
+	var codes [256]huffmanCode
+	fillCodeTable(freqTableTree(freqs), 0, 0, codes[:])
+
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, freqs); err != nil {
+		t.Fatal(err)
+	}
+	bw := bitio.NewWriter(&buf)
+	for _, b := range data {
+		bw.WriteBits(codes[b].bits, codes[b].len)
+	}
+	bw.Flush()
+	return buf.Bytes()
+}
+
+func TestFormatVersion(t *testing.T) {
+	text := reproInputs()[0].data[:5000]
+	old := freqTableFile(t, text)
+	if v := formatVersion(old); v != VERSION_FREQ_TABLE {
+		t.Fatalf("tabela de frequências detectada como %s", formatName(v))
+	}
+	restored, _, err := DecompressAnyVersion(old)
+	if err != nil || !bytes.Equal(restored, text) {
+		t.Fatalf("tabela de frequências: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ViktorCompressWithOptions(text, TYPE_TEXT, 0, DefaultOptions(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if v := formatVersion(buf.Bytes()); v != HEADER_VERSION {
+		t.Fatalf("v%d detectado como %s", HEADER_VERSION, formatName(v))
+	}
+	for _, file := range [][]byte{buf.Bytes(), freqTableFile(t, text)} {
+		restored, _, err := DecompressAnyVersionFrom(bytes.NewReader(file))
+		if err != nil || !bytes.Equal(restored, text) {
+			t.Fatalf("%s pelo reader: %v", formatName(formatVersion(file)), err)
+		}
+	}
+
+	// Uma tabela que começa com "YS": 89 ('Y') bytes distintos a partir de
+	// 'S'. A versão 'S' não existe, então ela continua sendo a tabela.
+	var ys []byte
+	for b := byte('S'); b < 'S'+89; b++ {
+		ys = append(ys, b, b)
+	}
+	old = freqTableFile(t, ys)
+	if string(old[:2]) != HEADER_MAGIC {
+		t.Fatalf("tabela começa com %q", old[:2])
+	}
+	if v := formatVersion(old); v != VERSION_FREQ_TABLE {
+		t.Fatalf("tabela com \"YS\" detectada como %s", formatName(v))
+	}
+	restored, _, err = DecompressAnyVersion(old)
+	if err != nil || !bytes.Equal(restored, ys) {
+		t.Fatalf("tabela com \"YS\": %v", err)
+	}
+	restored, _, err = DecompressAnyVersionFrom(bytes.NewReader(old))
+	if err != nil || !bytes.Equal(restored, ys) {
+		t.Fatalf("tabela com \"YS\" pelo reader: %v", err)
+	}
+
+	p := filepath.Join(t.TempDir(), "ys.bin.ys")
+	if err := os.WriteFile(p, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if from, err := upgradeFile(p); err != nil || from != VERSION_FREQ_TABLE {
+		t.Fatalf("upgrade da tabela com \"YS\": %s, %v", formatName(from), err)
+	}
+	upgraded, _ := os.ReadFile(p)
+	if v := formatVersion(upgraded); v != HEADER_VERSION {
+		t.Fatalf("upgrade gravou %s", formatName(v))
+	}
+	if restored, _, err := DecompressAnyVersion(upgraded); err != nil || !bytes.Equal(restored, ys) {
+		t.Fatalf("arquivo atualizado: %v", err)
+	}
+
+	// Versão mais nova que a suportada: erro, nunca "formato atual"
+	future := append([]byte(nil), upgraded...)
+	future[2] = HEADER_VERSION + 1
+	if err := os.WriteFile(p, future, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upgradeFile(p); err == nil {
+		t.Fatalf("upgrade aceitou v%d", HEADER_VERSION+1)
+	}
+}
@@ -1,43 +1,119 @@
 package main
 
-type LZ77Symbol struct {
-	Code      int // O código que vai para a árvore de Huffman
-	ExtraBits int // Quantidade de bits extras para gravar
-	ExtraVal  int // O valor dos bits extras
+// Símbolo LZ77 empacotado em 32 bits, em vez de três ints (24 bytes) por
+// símbolo: [valor extra 18 bits][bits extras 4 bits][código 10 bits].
+// Literais são o próprio byte, sem bits extras.
+type LZ77Symbol uint32
+
+func newLZ77Symbol(code, extraBits, extraVal int) LZ77Symbol {
+	return LZ77Symbol(uint32(code) | uint32(extraBits)<<10 | uint32(extraVal)<<14)
+}
+
+// O código que vai para a árvore de Huffman
+func (s LZ77Symbol) Code() int { return int(s & 0x3FF) }
+
+// Quantidade de bits extras para gravar
+func (s LZ77Symbol) ExtraBits() int { return int(s >> 10 & 0xF) }
+
+// O valor dos bits extras
+func (s LZ77Symbol) ExtraVal() int { return int(s >> 14) }
+
+const (
+	lz77Alphabet   = 332 // Literais, EOF, comprimentos (257-285) e distâncias (300-331)
+	lz77WindowSize = 65536
+	lz77HashSize   = 1 << 15
+)
+
+// Tabelas do LZ77 reaproveitadas entre chamadas pelo Encoder, para que
+// comprimir vários buffers seguidos não aloque de novo
+type lz77Matcher struct {
+	settings matchSettings
+
+	// MATCH_HASH_CHAIN
+	head   []int
+	prev   []int
+	padded []byte
+
+	// MATCH_MULTI_HASH e MATCH_BT4
+	multi         *multiHashFinder
+	bt            *bt4Finder
+	matches, next []lz77Match
 }
 
 func LZ77Compress(data []byte, isImage bool) []LZ77Symbol {
+	var m lz77Matcher
+	return m.compress(data, isImage, nil)
+}
+
+// Como o LZ77Compress, com o buscador de matches do nível (matchfinder.go)
+func LZ77CompressLevel(data []byte, isImage bool, level int) []LZ77Symbol {
+	m := lz77Matcher{settings: matchSettingsForLevel(level)}
+	return m.compress(data, isImage, nil)
+}
+
+// Acrescenta os símbolos de data em symbols (que pode vir de uma chamada
+// anterior, com len 0) e devolve o slice
+func (m *lz77Matcher) compress(data []byte, isImage bool, symbols []LZ77Symbol) []LZ77Symbol {
+	minMatch := 6
+	if !isImage {
+		minMatch = 3
+	}
+	if len(data) < 3 {
+		return emitLiterals(data, symbols)
+	}
+	if symbols == nil {
+		symbols = make([]LZ77Symbol, 0, len(data)/2)
+	}
+
+	switch m.settings.finder {
+	case MATCH_MULTI_HASH:
+		if m.multi == nil {
+			m.multi = &multiHashFinder{}
+		}
+		return m.compressWithFinder(data, minMatch, m.multi, m.settings, symbols)
+	case MATCH_BT4:
+		if m.bt == nil {
+			m.bt = &bt4Finder{}
+		}
+		settings := m.settings
+		if isImage {
+			// Resíduos de imagem têm muitos candidatos com o mesmo começo e
+			// o mais recente raramente é o mais longo
+			settings.nice = lz77MaxMatch
+		}
+		return m.compressWithFinder(data, minMatch, m.bt, settings, symbols)
+	}
+	return m.compressHashChain(data, minMatch, symbols)
+}
+
+func (m *lz77Matcher) compressHashChain(data []byte, minMatch int, symbols []LZ77Symbol) []LZ77Symbol {
 	const (
-		windowSize = 65536
+		windowSize = lz77WindowSize
 		windowMask = windowSize - 1
-		hashSize   = 1 << 15
+		hashSize   = lz77HashSize
 		hashMask   = hashSize - 1
 		maxMatch   = 258
 		//minMatch   = 6
 		hShift = 6
 	)
 
-	minMatch := 6
-	if !isImage {
-		minMatch = 3
-	}
-
 	inputSize := len(data)
-	if inputSize < 3 {
-		return emitLiterals(data)
-	}
 
-	paddedData := make([]byte, inputSize+4)
+	if cap(m.padded) < inputSize+4 {
+		m.padded = make([]byte, inputSize+4)
+	}
+	paddedData := m.padded[:inputSize+4]
 	copy(paddedData, data)
+	clear(paddedData[inputSize:])
 
-	var symbols []LZ77Symbol
-	symbols = make([]LZ77Symbol, 0, inputSize/2)
-
-	head := make([]int, hashSize)
+	if m.head == nil {
+		m.head = make([]int, hashSize)
+		m.prev = make([]int, windowSize)
+	}
+	head, prev := m.head, m.prev
 	for i := range head {
 		head[i] = -1
 	}
-	prev := make([]int, windowSize)
 
 	// Inicializa o hash com os dois primeiros bytes
 	h := (uint32(paddedData[0]) << hShift) ^ uint32(paddedData[1])
@@ -121,16 +197,16 @@ func LZ77Compress(data []byte, isImage bool) []LZ77Symbol {
 
 			// DECISÃO: Se o próximo match for estritamente melhor, adiamos o atual
 			if nextLen > currentLen || (nextLen == currentLen && nextDist < currentDist/2) {
-				symbols = append(symbols, LZ77Symbol{Code: int(paddedData[i])})
+				symbols = append(symbols, LZ77Symbol(paddedData[i]))
 				i++
 				continue
 			}
 
 			// Caso contrário, emite o match atual (que é o melhor)
 			c, eb, ev := GetLengthData(currentLen)
-			symbols = append(symbols, LZ77Symbol{Code: c, ExtraBits: eb, ExtraVal: ev})
+			symbols = append(symbols, newLZ77Symbol(c, eb, ev))
 			dc, deb, dev := GetDistanceData(currentDist)
-			symbols = append(symbols, LZ77Symbol{Code: dc, ExtraBits: deb, ExtraVal: dev})
+			symbols = append(symbols, newLZ77Symbol(dc, deb, dev))
 
 			// Atualiza o dicionário para os bytes consumidos
 			for j := 1; j < currentLen; j++ {
@@ -144,20 +220,19 @@ func LZ77Compress(data []byte, isImage bool) []LZ77Symbol {
 			i += currentLen
 		} else {
 			// Literal (Match menor que minMatch)
-			symbols = append(symbols, LZ77Symbol{Code: int(paddedData[i])})
+			symbols = append(symbols, LZ77Symbol(paddedData[i]))
 			i++
 		}
 	}
 	// EOF Symbol
-	return append(symbols, LZ77Symbol{Code: 256})
+	return append(symbols, LZ77Symbol(256))
 }
 
-func emitLiterals(data []byte) []LZ77Symbol {
-	symbols := make([]LZ77Symbol, 0, len(data)+1)
+func emitLiterals(data []byte, symbols []LZ77Symbol) []LZ77Symbol {
 	for _, b := range data {
-		symbols = append(symbols, LZ77Symbol{Code: int(b)})
+		symbols = append(symbols, LZ77Symbol(b))
 	}
-	return append(symbols, LZ77Symbol{Code: 256})
+	return append(symbols, LZ77Symbol(256))
 }
 
 // Retorna o código Huffman base e os bits extras necessários
@@ -3,57 +3,228 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"image"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const (
-	TYPE_TEXT = 0
-	TYPE_IMG  = 1
+	TYPE_TEXT   = 0
+	TYPE_IMG    = 1
+	TYPE_BINARY = 2 // Modo genérico: qualquer conteúdo que não seja texto nem imagem
 )
 
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Your Sync CLI - Uso:")
-		fmt.Println("  run . compress <arquivo.png>  - Comprime uma imagem para .ys")
+		fmt.Println("  run . compress [-1..-9] [--near N] [--adaptive] [--rle] [--prepass rle|auto] [-o saida] [--force] [--no-name] <arquivo>  - Comprime para <arquivo>.ys (tipo detectado pelo conteúdo)")
+		fmt.Println("  run . decompress [-o saida] [--force] [--keep] <arquivo.ys>  - Restaura o original (remove o .ys sem --keep)")
 		fmt.Println("  run . view <arquivo.ys>      - Abre o visualizador web")
+		fmt.Println("  run . thumbnail [-o saida.png] <arquivo.ys> [lado]  - Gera uma prévia PNG sem descomprimir a imagem inteira")
+		fmt.Println("  run . pack [--solid] <diretório> [saida.ysa]  - Empacota um diretório num arquivo .ysa")
+		fmt.Println("  run . list <arquivo.ysa>            - Lista as entradas do arquivo")
+		fmt.Println("  run . extract [--force] <arquivo.ysa> <nome>  - Extrai uma única entrada")
+		fmt.Println("  run . repro [-1..-9] [...] <arquivo>  - Confere que a saída é a mesma byte a byte em várias execuções")
+		fmt.Println("  run . upgrade <arquivo|diretório>  - Regrava arquivos .ys antigos no formato atual")
+		fmt.Println("  run . stream [-d] [-1..-9] [-o saida]  - Comprime (ou descomprime com -d) a entrada padrão à medida que chega")
 		return
 	}
 
 	command := os.Args[1]
 
+	flags, args, err := parseFlags(os.Args[2:])
+	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+
 	switch command {
 	case "compress":
-		if len(os.Args) < 3 {
-			fmt.Println("Erro: informe o caminho da imagem.")
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o caminho do arquivo.")
 			return
 		}
-		execCompress(os.Args[2])
+		execCompress(args[0], flags)
 
 	case "view":
-		if len(os.Args) < 3 {
-			fmt.Println("Erro: informe o arquivo comprimido (pode ser .ys ou .txt")
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o arquivo comprimido (.ys)")
 			return
 		}
-		startYourSyncServer(os.Args[2])
+		startYourSyncServer(args[0])
 
-	case "decompress": // Novo caso
-		if len(os.Args) < 3 {
+	case "decompress":
+		if len(args) < 1 {
 			fmt.Println("Erro: informe o arquivo .ys para extração.")
 			return
 		}
-		execDecompress(os.Args[2])
+		execDecompress(args[0], flags)
+
+	case "thumbnail":
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o arquivo .ys.")
+			return
+		}
+		size := THUMBNAIL_SIZE_DEFAULT
+		if len(args) >= 2 {
+			size, err = strconv.Atoi(args[1])
+			if err != nil || size <= 0 {
+				fmt.Println("Erro: tamanho inválido:", args[1])
+				return
+			}
+		}
+		execThumbnail(args[0], size, flags)
+
+	case "pack":
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o diretório a empacotar.")
+			return
+		}
+		output := filepath.Base(filepath.Clean(args[0])) + ".ysa"
+		if len(args) >= 2 {
+			output = args[1]
+		}
+		execPack(args[0], output, flags.solid)
+
+	case "list":
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o arquivo .ysa.")
+			return
+		}
+		execList(args[0])
+
+	case "extract":
+		if len(args) < 2 {
+			fmt.Println("Erro: informe o arquivo .ysa e o nome da entrada.")
+			return
+		}
+		execExtract(args[0], args[1], flags)
+
+	case "repro":
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o arquivo de entrada.")
+			return
+		}
+		execRepro(args[0], flags)
+
+	case "upgrade":
+		if len(args) < 1 {
+			fmt.Println("Erro: informe o arquivo ou diretório.")
+			return
+		}
+		execUpgrade(args[0])
+
+	case "stream":
+		execStream(flags)
 
 	default:
 		fmt.Println("Comando desconhecido.")
 	}
 }
 
-func execDecompress(inputPath string) {
+// Flags no estilo do gzip, aceitas em qualquer posição
+type cliFlags struct {
+	output    string // -o, --output
+	force     bool   // -f, --force: sobrescreve a saída
+	keep      bool   // -k, --keep: mantém o .ys após o decompress
+	noName    bool   // -n, --no-name: não grava nome/mtime/permissões
+	solid     bool   // --solid (pack)
+	level     int    // -1 .. -9, --fast, --best (0 = LEVEL_DEFAULT)
+	noPreview bool   // --no-preview: não grava a pirâmide de prévias
+	near      uint8  // --near N: imagens com erro de até N por amostra (com perdas)
+	adaptive  bool   // --adaptive: Huffman adaptativo, sem árvores no arquivo
+	rle       bool   // --rle: streams em PackBits, sem LZ77 nem Huffman
+	prepass   uint8  // --prepass rle|auto|none: pré-passo RLE das imagens (padrão none)
+	decode    bool   // -d, --decompress (stream)
+}
+
+func parseFlags(args []string) (cliFlags, []string, error) {
+	var flags cliFlags
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-o", "--output":
+			if i+1 >= len(args) {
+				return flags, nil, fmt.Errorf("%s precisa de um caminho", args[i])
+			}
+			i++
+			flags.output = args[i]
+		case "-f", "--force":
+			flags.force = true
+		case "-k", "--keep":
+			flags.keep = true
+		case "-n", "--no-name":
+			flags.noName = true
+		case "--solid":
+			flags.solid = true
+		case "--no-preview":
+			flags.noPreview = true
+		case "--adaptive":
+			flags.adaptive = true
+		case "--rle":
+			flags.rle = true
+		case "--prepass":
+			if i+1 >= len(args) {
+				return flags, nil, fmt.Errorf("%s precisa de um valor", args[i])
+			}
+			i++
+			switch args[i] {
+			case "rle":
+				flags.prepass = PREPASS_RLE
+			case "auto":
+				flags.prepass = PREPASS_AUTO
+			case "none":
+				flags.prepass = PREPASS_NONE
+			default:
+				return flags, nil, fmt.Errorf("--prepass inválido: %s (esperado rle, auto ou none)", args[i])
+			}
+		case "-d", "--decompress":
+			flags.decode = true
+		case "--near":
+			if i+1 >= len(args) {
+				return flags, nil, fmt.Errorf("%s precisa de um valor", args[i])
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 || n > 0xFF {
+				return flags, nil, fmt.Errorf("--near inválido: %s (esperado 0-255)", args[i])
+			}
+			flags.near = uint8(n)
+		case "--fast":
+			flags.level = LEVEL_FASTEST
+		case "--best":
+			flags.level = LEVEL_BEST
+		case "-1", "-2", "-3", "-4", "-5", "-6", "-7", "-8", "-9":
+			flags.level = int(args[i][1] - '0')
+		default:
+			if strings.HasPrefix(args[i], "-") && len(args[i]) > 1 {
+				return flags, nil, fmt.Errorf("flag desconhecida: %s", args[i])
+			}
+			rest = append(rest, args[i])
+		}
+	}
+	return flags, rest, nil
+}
+
+// Opções de compressão vindas das flags (sem os metadados)
+func compressOptions(flags cliFlags) Options {
+	opts := DefaultOptions()
+	if flags.level != 0 {
+		opts.Level = flags.level
+	}
+	opts.Previews = !flags.noPreview
+	opts.Near = flags.near
+	opts.Adaptive = flags.adaptive
+	opts.RLE = flags.rle
+	opts.Prepass = flags.prepass
+	return opts
+}
+
+func execDecompress(inputPath string, flags cliFlags) {
 	fmt.Printf("--- Your Sync: Extraindo %s ---\n", inputPath)
 
 	file, err := os.Open(inputPath)
@@ -61,97 +232,265 @@ func execDecompress(inputPath string) {
 		fmt.Println("Erro ao abrir:", err)
 		return
 	}
-	defer file.Close()
 
-	// 1. Descomprime usando seu motor Huffman + LZ77
-	restored, dataType, width, err := ViktorDecompressAndGetMetadata(file)
+	// 1. Descomprime usando seu motor Huffman + LZ77 (ou o formato de
+	// tabela de frequências, em arquivos antigos)
+	restored, header, err := DecompressAnyVersionFrom(file)
+	file.Close()
 	if err != nil {
 		fmt.Println("Erro na descompressão:", err)
 		return
 	}
 
-	// 2. Define o nome base (ex: resultado.ys -> extraido)
-	baseName := "extraido_" + strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-
-	// 3. Reconstrói o arquivo original
-	err = ReconstructFile(restored, dataType, width, baseName)
+	kind, err := LookupKind(header.DataType)
 	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+	if header.Lossy() {
+		fmt.Printf("Aviso: arquivo com perdas, pixels com erro de até %d por amostra\n", header.Image.Near)
+	}
+
+	// 2. Define o nome de saída: -o, o nome original gravado no cabeçalho ou,
+	// para arquivos sem metadados, extraido_<base> com a extensão do tipo
+	outputPath := flags.output
+	if outputPath == "" {
+		if header.Meta != nil {
+			outputPath = filepath.Join(filepath.Dir(inputPath), restoredName(header.Meta.Name, kind))
+		} else {
+			outputPath = "extraido_" + strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath)) + kind.Extension
+		}
+	}
+
+	if filepath.Clean(outputPath) == filepath.Clean(inputPath) {
+		fmt.Println("Erro: a saída seria o próprio arquivo comprimido; use -o.")
+		return
+	}
+
+	// 3. Reconstrói o arquivo original no formato do tipo
+	if err := RestoreFile(restored, header, outputPath, flags.force); err != nil {
 		fmt.Println("Erro ao reconstruir arquivo:", err)
 		return
 	}
 
-	fmt.Printf("Sucesso! Arquivo reconstruído como %s\n", baseName)
+	fmt.Printf("Sucesso! Arquivo reconstruído como %s\n", outputPath)
+
+	// 4. Como o gzip: o comprimido só fica se pedido
+	if !flags.keep {
+		if err := os.Remove(inputPath); err != nil {
+			fmt.Println("Aviso: não foi possível remover o arquivo comprimido:", err)
+		}
+	}
+}
+
+// Imagens voltam sempre no formato do tipo (PNG); se o original era outro
+// formato, só a extensão muda para não gravar PNG com nome de .jpg
+func restoredName(original string, kind *PayloadKind) string {
+	name := filepath.Base(original)
+	ext := filepath.Ext(name)
+	if kind.IsImage && !strings.EqualFold(ext, kind.Extension) {
+		return strings.TrimSuffix(name, ext) + kind.Extension
+	}
+	return name
 }
 
-func execCompress(inputPath string) {
+func execCompress(inputPath string, flags cliFlags) {
 	fmt.Printf("--- Your Sync: Comprimindo %s ---\n", inputPath)
 
-	ext := strings.ToLower(inputPath)
+	fileData, err := os.ReadFile(inputPath)
+	if err != nil {
+		fmt.Println("Erro ao ler arquivo:", err)
+		return
+	}
 
-	var rawData []byte
-	var width int
-	var dataType uint8
+	// 1. Identificação pelo conteúdo (a extensão é ignorada)
+	det := DetectDataType(fileData)
+	dataType := det.DataType
+	rawData := fileData
+	width := 0
 
-	// 1. Identificação de IMAGEM
-	if strings.HasSuffix(ext, ".png") || strings.HasSuffix(ext, ".jpg") || strings.HasSuffix(ext, ".jpeg") {
-		fmt.Printf("--- YourSync: Modo IMAGEM [%s] ---\n", inputPath)
-		file, _ := os.Open(inputPath)
-		defer file.Close()
-		img, _, err := image.Decode(file)
-		if err != nil {
-			fmt.Println("Erro ao decodificar imagem:", err)
-			return
-		}
-		width = img.Bounds().Dx()
-		rawData = imageToRGBBytes(img)
-		dataType = TYPE_IMG
+	fmt.Printf("--- YourSync: Modo %s [%s] (%s, entropia %.2f bits/byte) ---\n",
+		getTypeName(dataType), inputPath, det.MIME, det.Entropy)
 
-		// 2. Identificação de TEXTO (TXT ou CSV)
-	} else if strings.HasSuffix(ext, ".txt") || strings.HasSuffix(ext, ".csv") {
-		fmt.Printf("--- YourSync: Modo TEXTO [%s] ---\n", inputPath)
-		var err error
-		rawData, err = os.ReadFile(inputPath)
+	// 2. Imagens são comprimidas pelos pixels, não pelo arquivo codificado
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+	if kind.IsImage {
+		width = det.Image.Bounds().Dx()
+		rawData = kind.FromImage(det.Image)
+	}
+
+	// 3. Metadados do original, a menos que --no-name
+	opts := compressOptions(flags)
+	if flags.near > 0 && kind.IsImage && kind.Depth == 8 {
+		fmt.Printf("Modo com perdas: erro máximo de %d por amostra\n", flags.near)
+	}
+	if !flags.noName {
+		opts.Meta, err = FileMetaFromPath(inputPath)
 		if err != nil {
-			fmt.Println("Erro ao ler arquivo:", err)
+			fmt.Println("Erro ao ler metadados:", err)
 			return
 		}
-		dataType = TYPE_TEXT
-		width = 0
-
-		// 3. Bloqueio de outros formatos
-	} else {
-		fmt.Printf("Erro: O formato '%s' não é suportado.\n", ext)
-		fmt.Println("Formatos aceitos: .png, .jpg, .txt, .csv")
-		return
 	}
 
-	// 3. Execução da Compressão com Barra de Progresso
+	// 4. Execução da Compressão com Barra de Progresso
 	var compressedBuffer bytes.Buffer
 
 	// Inicia a compressão
-	err := ViktorCompress(rawData, dataType, width, &compressedBuffer)
+	err = ViktorCompressWithOptions(rawData, dataType, width, opts, &compressedBuffer)
 	if err != nil {
 		fmt.Println("Erro na compressão:", err)
 		return
 	}
 
-	// 4. Salva o arquivo .ys
-	var outputName string
-
-	ext = strings.ToLower(filepath.Ext(inputPath))
-
-	if dataType == TYPE_IMG {
-		outputName = "resultado.ys"
-	} else {
-		baseName := strings.TrimSuffix(inputPath, ext)
-		outputName = baseName + "_comprimido.txt"
+	// 5. Salva o .ys ao lado do original (ou em -o), sem sobrescrever por padrão
+	outputName := flags.output
+	if outputName == "" {
+		outputName = inputPath + ".ys"
 	}
 
-	err = os.WriteFile(outputName, compressedBuffer.Bytes(), 0644)
+	err = writeNewFile(outputName, compressedBuffer.Bytes(), 0644, flags.force)
 	if err != nil {
 		fmt.Println("Erro crítico ao salvar arquivo:", err)
 		return
 	}
+	fmt.Printf("Gravado em %s\n", outputName)
 
 	fmt.Printf("Sucesso! Economia: %.2f%%\n", 100.0-(float64(compressedBuffer.Len())/float64(len(rawData))*100.0))
 }
+
+func execThumbnail(inputPath string, size int, flags cliFlags) {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		fmt.Println("Erro ao abrir:", err)
+		return
+	}
+	defer file.Close()
+
+	img, err := Thumbnail(file, size)
+	if err != nil {
+		fmt.Println("Erro ao gerar prévia:", err)
+		return
+	}
+
+	outputName := flags.output
+	if outputName == "" {
+		base := strings.TrimSuffix(inputPath, ".ys")
+		outputName = strings.TrimSuffix(base, filepath.Ext(base)) + ".thumb.png"
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		fmt.Println("Erro ao codificar PNG:", err)
+		return
+	}
+	if err := writeNewFile(outputName, buf.Bytes(), 0644, flags.force); err != nil {
+		fmt.Println("Erro ao salvar prévia:", err)
+		return
+	}
+	b := img.Bounds()
+	fmt.Printf("Prévia %dx%d gravada em %s\n", b.Dx(), b.Dy(), outputName)
+}
+
+func execPack(dir, outputPath string, solid bool) {
+	fmt.Printf("--- Your Sync: Empacotando %s ---\n", dir)
+	if solid {
+		fmt.Println("--- YourSync: Modo SÓLIDO ---")
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		fmt.Println("Erro ao criar arquivo:", err)
+		return
+	}
+	defer out.Close()
+
+	entries, err := PackDirectory(dir, out, outputPath, solid)
+	if err != nil {
+		fmt.Println("Erro ao empacotar:", err)
+		return
+	}
+
+	var total uint64
+	for _, e := range entries {
+		total += e.Size
+	}
+	info, _ := out.Stat()
+
+	fmt.Printf("Sucesso! %d arquivos em %s\n", len(entries), outputPath)
+	if total > 0 {
+		fmt.Printf("Economia: %.2f%%\n", 100.0-(float64(info.Size())/float64(total)*100.0))
+	}
+}
+
+func openArchiveFile(archivePath string) (*os.File, *ArchiveReader, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	ar, err := OpenArchive(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, ar, nil
+}
+
+func execList(archivePath string) {
+	file, ar, err := openArchiveFile(archivePath)
+	if err != nil {
+		fmt.Println("Erro ao abrir:", err)
+		return
+	}
+	defer file.Close()
+
+	fmt.Printf("%-10s %12s %12s  %-16s  %-12s  %s\n", "PERMISSÃO", "TAMANHO", "COMPRIMIDO", "MODIFICADO", "TIPO", "NOME")
+	solidCount := 0
+	for _, e := range ar.Entries {
+		// Entradas sólidas compartilham o payload; o tamanho é o do grupo
+		compressed := fmt.Sprintf("%d", e.CompressedSize)
+		if e.IsSolid() {
+			compressed += "*"
+			solidCount++
+		}
+		fmt.Printf("%-10s %12d %12s  %-16s  %-12s  %s\n",
+			e.Mode, e.Size, compressed, e.ModTime.Format("2006-01-02 15:04"), getTypeName(e.DataType), e.Name)
+	}
+	fmt.Printf("%d entradas\n", len(ar.Entries))
+	if solidCount > 0 {
+		fmt.Println("* tamanho do grupo sólido compartilhado pela entrada")
+	}
+}
+
+func execExtract(archivePath, name string, flags cliFlags) {
+	file, ar, err := openArchiveFile(archivePath)
+	if err != nil {
+		fmt.Println("Erro ao abrir:", err)
+		return
+	}
+	defer file.Close()
+
+	entry, err := ar.Find(name)
+	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+
+	outPath, err := ExtractEntry(ar, entry, ".", flags.force)
+	if err != nil {
+		fmt.Println("Erro ao extrair:", err)
+		return
+	}
+
+	fmt.Printf("Sucesso! %s extraído como %s\n", entry.Name, outPath)
+}
@@ -0,0 +1,344 @@
+package main
+
+import "math/bits"
+
+// Buscadores de match do LZ77, escolhidos pelo nível de compressão. O
+// formato não muda: só o que o codificador encontra (e quanto tempo leva).
+const (
+	MATCH_HASH_CHAIN = 0 // Cadeia de hash de 3 bytes, até 32768 candidatos (o original)
+	MATCH_MULTI_HASH = 1 // Hashes de 4 e 8 bytes, um candidato em cada
+	MATCH_BT4        = 2 // Árvore binária por hash de 4 bytes, como o bt4 do LZMA
+)
+
+type matchSettings struct {
+	finder uint8
+	depth  int  // Nós visitados por posição na árvore (MATCH_BT4)
+	nice   int  // Bytes comparados na árvore; matches desse tamanho são estendidos direto (MATCH_BT4)
+	lazy   bool // Olha a posição seguinte antes de emitir um match
+}
+
+// Níveis 1-3 trocam compressão por velocidade, 4-6 (e 0, o comportamento
+// original) mantêm a cadeia de hash e 7-9 buscam mais fundo na árvore
+func matchSettingsForLevel(level int) matchSettings {
+	switch {
+	case level >= 1 && level <= 2:
+		return matchSettings{finder: MATCH_MULTI_HASH}
+	case level == 3:
+		return matchSettings{finder: MATCH_MULTI_HASH, lazy: true}
+	case level == 7:
+		return matchSettings{finder: MATCH_BT4, depth: 256, nice: 32, lazy: true}
+	case level == 8:
+		return matchSettings{finder: MATCH_BT4, depth: 1024, nice: 64, lazy: true}
+	case level >= 9:
+		return matchSettings{finder: MATCH_BT4, depth: 4096, nice: 128, lazy: true}
+	}
+	return matchSettings{finder: MATCH_HASH_CHAIN}
+}
+
+type lz77Match struct {
+	length, dist int
+}
+
+// find devolve os candidatos da posição i em ordem crescente de comprimento
+// (cada um mais longo que o anterior) e insere i nas tabelas; skip só
+// insere. As posições são visitadas em ordem, cada uma uma única vez.
+// setData troca o buffer por outro com o mesmo começo, mais longo, sem
+// perder as tabelas (o StreamWriter acrescenta dados entre as chamadas).
+type matchFinder interface {
+	reset(data []byte, s matchSettings)
+	setData(data []byte)
+	find(i int, matches []lz77Match) []lz77Match
+	skip(i int)
+}
+
+const (
+	lz77MaxMatch   = 258
+	finderHashBits = 16
+)
+
+func hash4(b []byte) uint32 {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	return v * 2654435761 >> (32 - finderHashBits)
+}
+
+func hash8(b []byte) uint32 {
+	v := uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+	return uint32(v * 0x9E3779B97F4A7C15 >> (64 - finderHashBits))
+}
+
+func fillInt(s []int, v int) {
+	for i := range s {
+		s[i] = v
+	}
+}
+
+// Comprimento comum entre data[a:] e data[b:], até limit
+func matchLength(data []byte, a, b, limit int) int {
+	n := 0
+	for n < limit && data[a+n] == data[b+n] {
+		n++
+	}
+	return n
+}
+
+// Dois hashes sem cadeia: a última posição com os mesmos 8 bytes (matches
+// longos e distantes, comuns em logs) e a última com os mesmos 4 bytes
+type multiHashFinder struct {
+	data         []byte
+	head4, head8 []int
+}
+
+func (f *multiHashFinder) reset(data []byte, _ matchSettings) {
+	f.data = data
+	if f.head4 == nil {
+		f.head4 = make([]int, 1<<finderHashBits)
+		f.head8 = make([]int, 1<<finderHashBits)
+	}
+	fillInt(f.head4, -1)
+	fillInt(f.head8, -1)
+}
+
+func (f *multiHashFinder) setData(data []byte) { f.data = data }
+
+func (f *multiHashFinder) find(i int, matches []lz77Match) []lz77Match {
+	data := f.data
+	limit := min(lz77MaxMatch, len(data)-i)
+	if limit < 4 {
+		return matches
+	}
+
+	c8 := -1
+	if limit >= 8 {
+		h := hash8(data[i:])
+		c8 = f.head8[h]
+		f.head8[h] = i
+	}
+	h := hash4(data[i:])
+	c4 := f.head4[h]
+	f.head4[h] = i
+
+	best := 0
+	for _, c := range [2]int{c4, c8} {
+		if c < 0 || i-c > lz77WindowSize {
+			continue
+		}
+		if n := matchLength(data, c, i, limit); n > best {
+			best = n
+			matches = append(matches, lz77Match{n, i - c})
+		}
+	}
+	return matches
+}
+
+func (f *multiHashFinder) skip(i int) {
+	data := f.data
+	if len(data)-i >= 8 {
+		f.head8[hash8(data[i:])] = i
+	}
+	if len(data)-i >= 4 {
+		f.head4[hash4(data[i:])] = i
+	}
+}
+
+// Árvore binária de busca por bucket de hash de 4 bytes (bt4 do LZMA). Cada
+// posição vira a raiz da árvore do seu bucket; descer a árvore visita os
+// candidatos em ordem lexicográfica, então em poucos passos chega ao match
+// mais longo e, no caminho, a todos os comprimentos intermediários. Um hash
+// de 3 bytes à parte cobre os matches de 3 (o mínimo para texto).
+type bt4Finder struct {
+	data        []byte
+	depth, nice int
+	head3       []int
+	head4       []int
+	son         []int // Filhos esquerdo/direito de cada posição da janela
+}
+
+func (f *bt4Finder) reset(data []byte, s matchSettings) {
+	f.data, f.depth, f.nice = data, s.depth, s.nice
+	if f.head4 == nil {
+		f.head3 = make([]int, 1<<finderHashBits)
+		f.head4 = make([]int, 1<<finderHashBits)
+		f.son = make([]int, 2*lz77WindowSize)
+	}
+	fillInt(f.head3, -1)
+	fillInt(f.head4, -1)
+}
+
+func (f *bt4Finder) setData(data []byte) { f.data = data }
+
+func hash3(b []byte) uint32 {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	return v * 2654435761 >> (32 - finderHashBits)
+}
+
+func (f *bt4Finder) find(i int, matches []lz77Match) []lz77Match {
+	return f.insert(i, matches, true)
+}
+
+func (f *bt4Finder) skip(i int) {
+	f.insert(i, nil, false)
+}
+
+func (f *bt4Finder) insert(i int, matches []lz77Match, record bool) []lz77Match {
+	data := f.data
+	maxLen := min(lz77MaxMatch, len(data)-i)
+	limit := min(f.nice, maxLen)
+	if limit < 4 {
+		return matches
+	}
+
+	best := 0
+	h3 := hash3(data[i:])
+	if c := f.head3[h3]; record && c >= 0 && i-c <= lz77WindowSize {
+		if n := matchLength(data, c, i, maxLen); n >= 3 {
+			best = n
+			matches = append(matches, lz77Match{n, i - c})
+		}
+	}
+	f.head3[h3] = i
+
+	// A menos de nice bytes do fim do buffer a comparação para antes e a
+	// posição ficaria fora de ordem quando o buffer crescer (setData): ali a
+	// árvore só é consultada
+	link := maxLen >= f.nice
+	h4 := hash4(data[i:])
+	cur := f.head4[h4]
+	if link {
+		f.head4[h4] = i
+	}
+
+	// ptr0/ptr1: onde pendurar o próximo nó maior/menor que data[i:]
+	const window = lz77WindowSize
+	cyclic := i % window
+	ptr0, ptr1 := 2*cyclic+1, 2*cyclic
+	len0, len1 := 0, 0
+	for depth := f.depth; ; depth-- {
+		delta := i - cur
+		if cur < 0 || depth == 0 || delta >= window {
+			if link {
+				f.son[ptr0], f.son[ptr1] = -1, -1
+			}
+			return matches
+		}
+		pair := 2 * (cur % window)
+
+		n := min(len0, len1)
+		if data[cur+n] == data[i+n] {
+			n += matchLength(data, cur+n, i+n, limit-n)
+			if n == limit {
+				// Igual até o limite: i herda os filhos de cur, e o match
+				// continua além do que a árvore compara
+				if link {
+					f.son[ptr1], f.son[ptr0] = f.son[pair], f.son[pair+1]
+				}
+				if record {
+					n += matchLength(data, cur+n, i+n, maxLen-n)
+					if n > best {
+						matches = append(matches, lz77Match{n, delta})
+					}
+				}
+				return matches
+			}
+			if record && n > best {
+				best = n
+				matches = append(matches, lz77Match{n, delta})
+			}
+		}
+
+		if data[cur+n] < data[i+n] {
+			if link {
+				f.son[ptr1] = cur
+			}
+			ptr1 = pair + 1
+			cur = f.son[ptr1]
+			len1 = n
+		} else {
+			if link {
+				f.son[ptr0] = cur
+			}
+			ptr0 = pair
+			cur = f.son[ptr0]
+			len0 = n
+		}
+	}
+}
+
+// Custo aproximado de um match em bits economizados: 8 por byte coberto,
+// menos os bits extras da distância
+func matchScore(m lz77Match) int {
+	return 8*m.length - bits.Len(uint(m.dist))
+}
+
+func bestMatch(matches []lz77Match, minMatch int) (lz77Match, bool) {
+	var best lz77Match
+	found := false
+	for _, m := range matches {
+		if m.length >= minMatch && (!found || matchScore(m) > matchScore(best)) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// Parser guloso (com avaliação preguiçosa opcional) sobre um matchFinder
+func (m *lz77Matcher) compressWithFinder(data []byte, minMatch int, f matchFinder, settings matchSettings, symbols []LZ77Symbol) []LZ77Symbol {
+	f.reset(data, settings)
+	symbols, _ = m.parseRange(data, 0, len(data), minMatch, f, settings, symbols)
+
+	// EOF Symbol
+	return append(symbols, LZ77Symbol(256))
+}
+
+// Codifica as posições de start até end (os matches podem passar de end e
+// ir até o fim de data) e devolve onde a próxima chamada deve começar. As
+// posições antes de start já precisam estar no buscador.
+func (m *lz77Matcher) parseRange(data []byte, start, end, minMatch int, f matchFinder, settings matchSettings, symbols []LZ77Symbol) ([]LZ77Symbol, int) {
+	if start >= end {
+		return symbols, start
+	}
+	cur := f.find(start, m.matches[:0])
+	i := start
+	for i < end {
+		best, ok := bestMatch(cur, minMatch)
+		if !ok {
+			symbols = append(symbols, LZ77Symbol(data[i]))
+			i++
+			if i < end {
+				cur = f.find(i, cur[:0])
+			}
+			continue
+		}
+
+		if settings.lazy && i+1 < end {
+			next := f.find(i+1, m.next[:0])
+			m.next = next
+			if nb, ok := bestMatch(next, minMatch); ok && matchScore(nb) > matchScore(best) {
+				// O match seguinte é melhor: adia com um literal
+				symbols = append(symbols, LZ77Symbol(data[i]))
+				i++
+				cur, m.next = next, cur
+				continue
+			}
+			for j := i + 2; j < i+best.length; j++ {
+				f.skip(j)
+			}
+		} else {
+			for j := i + 1; j < i+best.length; j++ {
+				f.skip(j)
+			}
+		}
+
+		c, eb, ev := GetLengthData(best.length)
+		symbols = append(symbols, newLZ77Symbol(c, eb, ev))
+		dc, deb, dev := GetDistanceData(best.dist)
+		symbols = append(symbols, newLZ77Symbol(dc, deb, dev))
+
+		i += best.length
+		if i < end {
+			cur = f.find(i, cur[:0])
+		}
+	}
+	m.matches = cur
+	return symbols, i
+}
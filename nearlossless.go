@@ -0,0 +1,59 @@
+package main
+
+// Modo quase sem perdas, no estilo do NEAR do JPEG-LS. O preditor é o mesmo
+// (left+up)/2 do filtro original, mas calculado sobre os pixels já
+// reconstruídos, e o resíduo é quantizado em passos de 2n+1:
+//
+//	q = sinal(e) * (|e| + n) / (2n+1)      x' = pred + q*(2n+1)
+//
+// Assim cada amostra volta com erro absoluto de no máximo n, e os resíduos
+// ficam até 2n+1 vezes menores. Para n >= 1, |q| <= 85 e cabe num int8.
+
+// Resíduos quantizados, um byte por amostra (int8)
+func ApplyNearLosslessFilter(data []byte, width int, channels int, near uint8) []byte {
+	rowSize := width * channels
+	step := 2*int(near) + 1
+	recon := make([]byte, len(data))
+	residuals := make([]byte, len(data))
+
+	// Sequencial: cada predição depende da reconstrução anterior
+	for i, v := range data {
+		pred := nearPrediction(recon, i, rowSize, channels)
+		e := int(v) - pred
+
+		q := (abs(e) + int(near)) / step
+		if e < 0 {
+			q = -q
+		}
+		residuals[i] = byte(int8(q))
+		recon[i] = clampByte(pred + q*step)
+	}
+	return residuals
+}
+
+func RemoveNearLosslessFilter(residuals []byte, width int, channels int, near uint8) []byte {
+	rowSize := width * channels
+	step := 2*int(near) + 1
+	recon := make([]byte, len(residuals))
+
+	for i, r := range residuals {
+		pred := nearPrediction(recon, i, rowSize, channels)
+		recon[i] = clampByte(pred + int(int8(r))*step)
+	}
+	return recon
+}
+
+func nearPrediction(recon []byte, i, rowSize, channels int) int {
+	var left, up int
+	if i%rowSize >= channels {
+		left = int(recon[i-channels])
+	}
+	if i >= rowSize {
+		up = int(recon[i-rowSize])
+	}
+	return (left + up) / 2
+}
+
+func clampByte(v int) byte {
+	return byte(min(max(v, 0), 255))
+}
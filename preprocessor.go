@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
 )
 
 func Apply2DFilter(data []byte, width int) []byte {
@@ -38,12 +44,25 @@ func Apply2DFilter(data []byte, width int) []byte {
 }
 
 func Apply2DFilterRGB(data []byte, width int) []byte {
-	rowSize := width * 3
+	return apply2DFilterChannels(data, width, 3)
+}
+
+func Apply2DFilterRGBA(data []byte, width int) []byte {
+	return apply2DFilterChannels(data, width, 4)
+}
+
+func Apply2DFilterGrayAlpha(data []byte, width int) []byte {
+	return apply2DFilterChannels(data, width, 2)
+}
+
+// Mesmo preditor (left+up)/2, com "left" sendo o mesmo canal do pixel anterior
+func apply2DFilterChannels(data []byte, width int, channels int) []byte {
+	rowSize := width * channels
 	height := len(data) / rowSize
 	filtered := make([]byte, len(data))
 
 	// paralelismo para maior perfomance
-	numCPU := runtime.NumCPU()
+	numCPU := runtime.GOMAXPROCS(0)
 	var wg sync.WaitGroup
 	chunkSize := height / numCPU
 
@@ -61,8 +80,8 @@ func Apply2DFilterRGB(data []byte, width int) []byte {
 				for x := range rowSize {
 					idx := y*rowSize + x
 					var left, up byte
-					if x >= 3 {
-						left = data[idx-3]
+					if x >= channels {
+						left = data[idx-channels]
 					}
 					if y > 0 {
 						up = data[idx-rowSize]
@@ -108,14 +127,26 @@ func Remove2DFilter(data []byte, width int) []byte {
 }
 
 func Remove2DFilterRGB(data []byte, width int) []byte {
-	rowSize := width * 3
+	return remove2DFilterChannels(data, width, 3)
+}
+
+func Remove2DFilterRGBA(data []byte, width int) []byte {
+	return remove2DFilterChannels(data, width, 4)
+}
+
+func Remove2DFilterGrayAlpha(data []byte, width int) []byte {
+	return remove2DFilterChannels(data, width, 2)
+}
+
+func remove2DFilterChannels(data []byte, width int, channels int) []byte {
+	rowSize := width * channels
 	restored := make([]byte, len(data))
 
 	for i := range data {
 		var left, up byte
 
-		if i%rowSize >= 3 {
-			left = restored[i-3]
+		if i%rowSize >= channels {
+			left = restored[i-channels]
 		}
 
 		if i >= rowSize {
@@ -128,17 +159,83 @@ func Remove2DFilterRGB(data []byte, width int) []byte {
 	return restored
 }
 
+// Escolhe o modo de imagem pelo conteúdo: quantos canais são realmente
+// necessários para o round-trip ser exato. Cinza exige R == G == B em todos
+// os pixels; sem alpha exige todos opacos.
+func ImageKindFor(img image.Image) uint8 {
+	if is16BitImage(img) {
+		return imageKindFor16(img)
+	}
+	if _, ok := img.(*image.Gray); ok {
+		return TYPE_IMG_GRAY
+	}
+
+	gray, opaque := true, true
+	visit := func(r, g, b, a uint8) bool {
+		if r != g || g != b {
+			gray = false
+		}
+		if a != 0xFF {
+			opaque = false
+		}
+		return gray || opaque // Nada mais a descobrir
+	}
+
+	bounds := img.Bounds()
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		// Caminho rápido: o decodificador PNG entrega NRGBA para RGBA e GA
+	scanNRGBA:
+		for y := range bounds.Dy() {
+			row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+bounds.Dx()*4]
+			for i := 0; i < len(row); i += 4 {
+				if !visit(row[i], row[i+1], row[i+2], row[i+3]) {
+					break scanNRGBA
+				}
+			}
+		}
+	} else {
+	scanGeneric:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if !visit(c.R, c.G, c.B, c.A) {
+					break scanGeneric
+				}
+			}
+		}
+	}
+
+	switch {
+	case gray && opaque:
+		return TYPE_IMG_GRAY
+	case gray:
+		return TYPE_IMG_GRAY_ALPHA
+	case opaque:
+		return TYPE_IMG_RGB
+	}
+	return TYPE_IMG_RGBA
+}
+
 func imageToGrayscaleBytes(img image.Image) []byte {
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 	data := make([]byte, width*height)
 
+	// Imagem já em cinza: copia os bytes sem passar pela luminância
+	if gray, ok := img.(*image.Gray); ok {
+		for y := range height {
+			copy(data[y*width:(y+1)*width], gray.Pix[y*gray.Stride:])
+		}
+		return data
+	}
+
 	for y := range height {
 		for x := range width {
 			r, g, b, _ := img.At(x, y).RGBA()
-			// Fórmula simples de luminância: 0.299R + 0.587G + 0.114B
+			// Fórmula simples de luminância: 0.299R + 0.587G + 0.114B, em
+			// inteiros para dar o mesmo byte em qualquer plataforma
 			// O RGBA retorna valores de 16 bits, precisa dividir por 256 ou deslocar 8
-			lum := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 256.0
+			lum := (299*r + 587*g + 114*b) / 1000 >> 8
 			data[y*width+x] = byte(lum)
 		}
 	}
@@ -152,7 +249,7 @@ func imageToRGBBytes(img image.Image) []byte {
 	data := make([]byte, width*height*3)
 
 	// paralelismo para maior perfomance
-	numCPU := runtime.NumCPU()
+	numCPU := runtime.GOMAXPROCS(0)
 	var wg sync.WaitGroup
 	chunkSize := height / numCPU
 
@@ -182,6 +279,42 @@ func imageToRGBBytes(img image.Image) []byte {
 	return data
 }
 
+// Converte para NRGBA (alpha não pré-multiplicado) para o round-trip ser exato
+func imageToRGBABytes(img image.Image) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	data := make([]byte, width*height*4)
+
+	for y := range height {
+		for x := range width {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			pos := (y*width + x) * 4
+			data[pos] = c.R
+			data[pos+1] = c.G
+			data[pos+2] = c.B
+			data[pos+3] = c.A
+		}
+	}
+	return data
+}
+
+// Pares [Y][A]; só usado quando R == G == B em todos os pixels
+func imageToGrayAlphaBytes(img image.Image) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	data := make([]byte, width*height*2)
+
+	for y := range height {
+		for x := range width {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			pos := (y*width + x) * 2
+			data[pos] = c.R
+			data[pos+1] = c.A
+		}
+	}
+	return data
+}
+
 func saveBytesAsPNGRGB(data []byte, width int, filename string) error {
 	// Calcula a altura baseada no tamanho total e largura (3 bytes por pixel)
 	height := len(data) / (width * 3)
@@ -238,25 +371,148 @@ func buildImageObject(data []byte, width int) image.Image {
 	return img
 }
 
-func ReconstructFile(data []byte, dataType uint8, width int, outputPath string) error {
-	if dataType == 1 {
-		height := len(data) / (width * 3)
-		img := image.NewRGBA(image.Rect(0, 0, width, height))
+func buildGrayImageObject(data []byte, width int) image.Image {
+	height := len(data) / width
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	copy(img.Pix, data)
+	return img
+}
+
+// O image/png não tem tipo Go para cinza+alpha; NRGBA preserva os valores
+func buildGrayAlphaImageObject(data []byte, width int) image.Image {
+	height := len(data) / (width * 2)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for i := 0; i < len(data)/2; i++ {
+		y, a := data[i*2], data[i*2+1]
+		img.Pix[i*4] = y
+		img.Pix[i*4+1] = y
+		img.Pix[i*4+2] = y
+		img.Pix[i*4+3] = a
+	}
+	return img
+}
+
+func buildRGBAImageObject(data []byte, width int) image.Image {
+	height := len(data) / (width * 4)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	copy(img.Pix, data)
+	return img
+}
+
+// Grava os dados restaurados exatamente em outputPath. Sem force, falha se o
+// arquivo já existir. Com metadados no cabeçalho, confere o tamanho (só nos
+// tipos gravados como estão; imagens voltam como PNG recodificado) e restaura
+// permissões e mtime. A saída passa por um temporário no mesmo diretório, de
+// modo que uma reconstrução com erro não deixa arquivo pela metade.
+func RestoreFile(data []byte, header *Header, outputPath string, force bool) error {
+	kind, err := LookupKind(header.DataType)
+	if err != nil {
+		return err
+	}
+
+	perm := os.FileMode(0644)
+	var mtime time.Time
+	if header.Meta != nil {
+		if !kind.IsImage && uint64(len(data)) != header.Meta.Size {
+			return fmt.Errorf("tamanho restaurado %d difere do original %d", len(data), header.Meta.Size)
+		}
+		perm, mtime = header.Meta.Mode, header.Meta.ModTime
+	}
+
+	return writeOutputFile(outputPath, perm, mtime, force, func(w io.Writer) error {
+		return kind.Reconstruct(w, data, header.Width)
+	})
+}
 
-		for i := 0; i < len(data); i += 3 {
-			idx := i / 3
-			y := idx / width
-			x := idx % width
-			img.Set(x, y, color.RGBA{data[i], data[i+1], data[i+2], 255})
+// Saída do decompress e do extract: sem force, falha se o arquivo já
+// existir; a gravação passa por writeAndRename
+func writeOutputFile(outputPath string, perm os.FileMode, mtime time.Time, force bool, write func(io.Writer) error) error {
+	if !force {
+		if _, err := os.Lstat(outputPath); err == nil {
+			return outputExistsError(outputPath)
 		}
+	}
+	return writeAndRename(outputPath, perm, mtime, write)
+}
+
+func outputExistsError(outputPath string) error {
+	return fmt.Errorf("%s já existe (use --force para sobrescrever)", outputPath)
+}
 
-		f, err := os.Create(outputPath + ".png")
-		if err != nil {
+// Grava por write num temporário ao lado de p e só troca por rename depois
+// de tudo gravado. mtime zero mantém o horário da gravação.
+func writeAndRename(p string, perm os.FileMode, mtime time.Time, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
 			return err
 		}
-		defer f.Close()
-		return png.Encode(f, img)
-	} else {
-		return os.WriteFile(outputPath+".txt", data, 0644)
 	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func createOutputFile(outputPath string, perm os.FileMode, force bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(outputPath, flags, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, outputExistsError(outputPath)
+	}
+	return f, err
+}
+
+func writeNewFile(outputPath string, data []byte, perm os.FileMode, force bool) error {
+	f, err := createOutputFile(outputPath, perm, force)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Grava os dados pelo hook de reconstrução do tipo, acrescentando a extensão
+// do tipo ao caminho. Retorna o caminho final.
+func ReconstructFile(data []byte, dataType uint8, width int, outputPath string) (string, error) {
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath += kind.Extension
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := kind.Reconstruct(f, data, width); err != nil {
+		return "", err
+	}
+	return outputPath, f.Close()
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Pirâmide de prévias (FLAG_PREVIEW). Cada nível é a imagem reduzida por
+// uma potência de 2, gravada como um .ys completo (cabeçalho + payload) na
+// seção do cabeçalho, antes do payload principal. O thumbnail lê só o
+// cabeçalho e decodifica o nível pedido, sem tocar na resolução original.
+//
+//	[níveis u8] e, por nível: [largura u16][altura u16][bytes u32][.ys]
+const (
+	// Maior nível gravado. Níveis maiores ficam caros: reduzir elimina a
+	// redundância entre pixels vizinhos e cada nível comprime mal.
+	previewMaxSide = 256
+	previewMinSide = 64 // Menor nível gravado
+
+	THUMBNAIL_SIZE_DEFAULT = 256
+)
+
+type Preview struct {
+	Width, Height int
+	Data          []byte // .ys da prévia
+}
+
+func (p *Preview) Decode() (image.Image, error) {
+	raw, header, err := ViktorDecompressWithHeader(bytes.NewReader(p.Data))
+	if err != nil {
+		return nil, err
+	}
+	kind, err := LookupKind(header.DataType)
+	if err != nil {
+		return nil, err
+	}
+	if !kind.IsImage {
+		return nil, fmt.Errorf("prévia sem dados de imagem")
+	}
+	return kind.ToImage(raw, header.Width), nil
+}
+
+// Gera os níveis do maior (<= previewMaxSide) para o menor. Imagens que já
+// cabem em previewMaxSide não ganham prévia.
+func buildPreviews(data []byte, width int, kind *PayloadKind, level int) ([]Preview, error) {
+	height := len(data) / (width * kind.PixelSize())
+	side := max(width, height)
+	if side <= previewMaxSide {
+		return nil, nil
+	}
+
+	factor := 2
+	for side/factor > previewMaxSide {
+		factor *= 2
+	}
+
+	img := downsampleImage(kind.ToImage(data, width), factor)
+	var previews []Preview
+	for {
+		p, err := encodePreview(img, level)
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, p)
+
+		b := img.Bounds()
+		if max(b.Dx(), b.Dy())/2 < previewMinSide {
+			break
+		}
+		img = downsampleImage(img, 2)
+	}
+	return previews, nil
+}
+
+func encodePreview(img image.Image, level int) (Preview, error) {
+	kindID := ImageKindFor(img)
+	kind, err := LookupKind(kindID)
+	if err != nil {
+		return Preview{}, err
+	}
+
+	b := img.Bounds()
+	opts := DefaultOptions()
+	opts.Level = level
+	opts.TileSize = 0
+	opts.Previews = false
+
+	var buf bytes.Buffer
+	if err := ViktorCompressWithOptions(kind.FromImage(img), kindID, b.Dx(), opts, &buf); err != nil {
+		return Preview{}, fmt.Errorf("prévia %dx%d: %w", b.Dx(), b.Dy(), err)
+	}
+	return Preview{Width: b.Dx(), Height: b.Dy(), Data: buf.Bytes()}, nil
+}
+
+func marshalPreviews(previews []Preview) ([]byte, error) {
+	if len(previews) > 0xFF {
+		return nil, fmt.Errorf("prévias demais: %d", len(previews))
+	}
+	buf := []byte{byte(len(previews))}
+	for _, p := range previews {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(p.Width))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(p.Height))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(p.Data)))
+		buf = append(buf, p.Data...)
+	}
+	return buf, nil
+}
+
+func readPreviews(r io.Reader) ([]Preview, error) {
+	var count [1]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		return nil, err
+	}
+	previews := make([]Preview, count[0])
+	for i := range previews {
+		var fixed struct {
+			Width, Height uint16
+			Len           uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &fixed); err != nil {
+			return nil, err
+		}
+		data := make([]byte, fixed.Len)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		previews[i] = Preview{Width: int(fixed.Width), Height: int(fixed.Height), Data: data}
+	}
+	return previews, nil
+}
+
+// Prévia com lado maior perto de maxSide: o menor nível que ainda tem pelo
+// menos maxSide, ou o maior disponível. Sem pirâmide no arquivo, decodifica a
+// imagem inteira e reduz.
+func Thumbnail(r io.Reader, maxSide int) (image.Image, error) {
+	header, kind, err := readPayloadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if !kind.IsImage {
+		return nil, fmt.Errorf("o arquivo não contém dados de imagem")
+	}
+
+	if len(header.Previews) > 0 {
+		best := &header.Previews[0]
+		for i := range header.Previews {
+			p := &header.Previews[i]
+			if max(p.Width, p.Height) >= maxSide {
+				best = p
+			}
+		}
+		return best.Decode()
+	}
+
+	restored, err := decompressBody(r, kind, header)
+	if err != nil {
+		return nil, err
+	}
+	img := kind.ToImage(restored, header.Width)
+
+	factor := 1
+	for b := img.Bounds(); max(b.Dx(), b.Dy())/factor > maxSide; {
+		factor *= 2
+	}
+	if factor == 1 {
+		return img, nil
+	}
+	return downsampleImage(img, factor), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+// Codificador aritmético binário adaptativo (range coder no estilo do LZMA).
+// Cada decisão binária usa uma probabilidade de 11 bits que se ajusta a cada
+// bit codificado, então um símbolo muito provável custa bem menos de 1 bit,
+// coisa que o Huffman estático não consegue.
+const (
+	rcProbBits  = 11
+	rcProbInit  = 1 << (rcProbBits - 1) // 50%
+	rcMoveBits  = 4                     // Velocidade de adaptação
+	rcTopValue  = 1 << 24
+	rcTreeWidth = 256 // Folhas de uma árvore de bits de 8 bits
+)
+
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func newRangeEncoder() *rangeEncoder {
+	return &rangeEncoder{rng: 0xFFFFFFFF, cacheSize: 1}
+}
+
+func (e *rangeEncoder) EncodeBit(prob *uint16, bit int) {
+	bound := (e.rng >> rcProbBits) * uint32(*prob)
+	if bit == 0 {
+		e.rng = bound
+		*prob += (1<<rcProbBits - *prob) >> rcMoveBits
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*prob -= *prob >> rcMoveBits
+	}
+	for e.rng < rcTopValue {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+// Propaga o carry: bytes 0xFF ficam pendentes (cacheSize) até se saber se
+// o próximo byte vai transbordar neles
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low >= 1<<32 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for {
+			e.out = append(e.out, temp+carry)
+			temp = 0xFF
+			e.cacheSize--
+			if e.cacheSize == 0 {
+				break
+			}
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = (e.low & 0x00FFFFFF) << 8
+}
+
+// Símbolo de 8 bits numa árvore de bits (probs com rcTreeWidth entradas)
+func (e *rangeEncoder) EncodeByte(probs []uint16, symbol byte) {
+	m := 1
+	for i := 7; i >= 0; i-- {
+		bit := int(symbol>>i) & 1
+		e.EncodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (e *rangeEncoder) Finish() []byte {
+	for range 5 {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+type rangeDecoder struct {
+	rng  uint32
+	code uint32
+	src  []byte
+	pos  int
+}
+
+func newRangeDecoder(src []byte) *rangeDecoder {
+	d := &rangeDecoder{rng: 0xFFFFFFFF, src: src}
+	for range 5 {
+		d.code = d.code<<8 | uint32(d.next())
+	}
+	return d
+}
+
+// Depois do fim do buffer devolve zeros; o chamador sabe quantos símbolos ler
+func (d *rangeDecoder) next() byte {
+	if d.pos >= len(d.src) {
+		d.pos++
+		return 0
+	}
+	b := d.src[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *rangeDecoder) DecodeBit(prob *uint16) int {
+	bound := (d.rng >> rcProbBits) * uint32(*prob)
+	var bit int
+	if d.code < bound {
+		d.rng = bound
+		*prob += (1<<rcProbBits - *prob) >> rcMoveBits
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*prob -= *prob >> rcMoveBits
+		bit = 1
+	}
+	for d.rng < rcTopValue {
+		d.rng <<= 8
+		d.code = d.code<<8 | uint32(d.next())
+	}
+	return bit
+}
+
+func (d *rangeDecoder) DecodeByte(probs []uint16) byte {
+	m := 1
+	for range 8 {
+		m = m<<1 | d.DecodeBit(&probs[m])
+	}
+	return byte(m)
+}
+
+// Leu mais bytes do que o stream tinha: dados truncados ou corrompidos
+func (d *rangeDecoder) Overrun() bool {
+	return d.pos > len(d.src)
+}
+
+func newProbs(n int) []uint16 {
+	probs := make([]uint16, n)
+	for i := range probs {
+		probs[i] = rcProbInit
+	}
+	return probs
+}
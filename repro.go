@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// Saída reproduzível: o mesmo conteúdo, com as mesmas opções e a mesma
+// versão da biblioteca, gera o mesmo .ys byte a byte em qualquer plataforma
+// e com qualquer GOMAXPROCS, então dá para deduplicar pelo hash do arquivo
+// comprimido. Para isso:
+//
+//   - nenhuma decisão do codificador depende da ordem de um mapa, do relógio
+//     ou de números aleatórios;
+//   - as estimativas que escolhem pré-passo, transformada, layout e backend
+//     de entropia são inteiras (EstimateCompressedBits), sem arredondamento de
+//     ponto flutuante, que pode variar entre arquiteturas;
+//   - as árvores de Huffman saem de uma ordem total (PriorityQueue.Less);
+//   - o trabalho em paralelo (linhas dos filtros, tiles) grava cada parte
+//     numa posição fixa, então a divisão entre goroutines não chega à saída;
+//   - um Encoder reaproveitado produz o mesmo que um novo.
+//
+// Nome, tamanho, mtime e permissões (FLAG_META) fazem parte da entrada: o
+// mesmo conteúdo com outro mtime dá outro arquivo, a menos que se use
+// --no-name. Versões diferentes da biblioteca podem gerar saídas
+// diferentes (e todas continuam legíveis); repro_test.go fixa os hashes da
+// versão atual.
+
+// repro <arquivo>: comprime o arquivo várias vezes, com GOMAXPROCS
+// diferentes e com um Encoder novo e outro reaproveitado, e confere que a
+// saída é sempre a mesma. O hash impresso serve para comparar entre
+// máquinas.
+func execRepro(inputPath string, flags cliFlags) {
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		fmt.Println("Erro ao ler arquivo:", err)
+		return
+	}
+
+	det := DetectDataType(data)
+	kind, err := LookupKind(det.DataType)
+	if err != nil {
+		fmt.Println("Erro:", err)
+		return
+	}
+	width := 0
+	if kind.IsImage {
+		width = det.Image.Bounds().Dx()
+		data = kind.FromImage(det.Image)
+	}
+	opts := compressOptions(flags)
+	fmt.Printf("--- Your Sync: Reprodutibilidade [%s] (%s, nível %d) ---\n", inputPath, kind.Name, opts.Level)
+
+	procs := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(procs)
+
+	var outputs [][]byte
+	var report []string
+	for _, n := range []int{1, 2, 7, max(procs, 16)} {
+		runtime.GOMAXPROCS(n)
+		var out bytes.Buffer
+		if err := ViktorCompressWithOptions(data, det.DataType, width, opts, &out); err != nil {
+			fmt.Println("Erro na compressão:", err)
+			return
+		}
+		outputs = append(outputs, out.Bytes())
+		report = append(report, fmt.Sprintf("GOMAXPROCS=%-4d %x (%d bytes)", n, sha256.Sum256(out.Bytes()), out.Len()))
+	}
+
+	// O Encoder guarda tabelas entre chamadas; depois de outra entrada ele
+	// tem que produzir o mesmo que um novo
+	var fresh, reused bytes.Buffer
+	enc := NewEncoder(&fresh)
+	enc.SetLevel(opts.Level)
+	if err := enc.Encode(data, kind.IsImage); err != nil {
+		fmt.Println("Erro no Encoder:", err)
+		return
+	}
+	rotated := append(append([]byte{}, data[len(data)/2:]...), data[:len(data)/2]...)
+	enc.Reset(io.Discard)
+	enc.Encode(rotated, kind.IsImage)
+	enc.Reset(&reused)
+	if err := enc.Encode(data, kind.IsImage); err != nil {
+		fmt.Println("Erro no Encoder:", err)
+		return
+	}
+
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	fmt.Printf("Encoder         %x (%d bytes)\n", sha256.Sum256(fresh.Bytes()), fresh.Len())
+
+	same := bytes.Equal(fresh.Bytes(), reused.Bytes())
+	for _, out := range outputs[1:] {
+		same = same && bytes.Equal(out, outputs[0])
+	}
+	if !same {
+		fmt.Println("DIVERGÊNCIA: a mesma entrada gerou saídas diferentes")
+		os.Exit(1)
+	}
+
+	restored, err := ViktorDecompress(bytes.NewReader(outputs[0]))
+	if err != nil {
+		fmt.Println("Erro na descompressão:", err)
+		os.Exit(1)
+	}
+	if opts.Near == 0 && !bytes.Equal(restored, data) {
+		fmt.Println("DIVERGÊNCIA: a descompressão não devolveu a entrada")
+		os.Exit(1)
+	}
+	fmt.Println("OK: saída idêntica em todas as execuções")
+}
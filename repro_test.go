@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// Entradas fixas geradas aqui mesmo, sem depender de arquivos nem de
+// math/rand
+func reproInputs() []struct {
+	name     string
+	dataType uint8
+	width    int
+	data     []byte
+} {
+	seed := uint32(1)
+	next := func() uint32 {
+		seed = seed*1664525 + 1013904223
+		return seed >> 8
+	}
+
+	var log bytes.Buffer
+	levels := []string{"INFO", "WARN", "ERROR", "DEBUG"}
+	for i := range 4000 {
+		fmt.Fprintf(&log, "2024-03-%02d 12:%02d:%02d [%s] req=%d user=%d latency=%dms path=/api/v%d/items\n",
+			1+i%28, i%60, next()%60, levels[next()%4], i, next()%500, next()%900, next()%3)
+	}
+
+	binary := make([]byte, 64<<10)
+	for i := range binary {
+		if i%7 == 0 {
+			binary[i] = byte(next())
+		} else {
+			binary[i] = byte(i / 97)
+		}
+	}
+
+	const w, h = 300, 200
+	rgb := make([]byte, w*h*3)
+	for y := range h {
+		for x := range w {
+			p := rgb[(y*w+x)*3:]
+			p[0], p[1], p[2] = byte(x+y), byte(x*y/64), byte(next()%8)
+			if x > 100 && x < 200 && y > 50 && y < 150 {
+				p[0], p[1], p[2] = 0x20, 0x40, 0x60
+			}
+		}
+	}
+
+	return []struct {
+		name     string
+		dataType uint8
+		width    int
+		data     []byte
+	}{
+		{"texto", TYPE_TEXT, 0, log.Bytes()},
+		{"binario", TYPE_BINARY, 0, binary},
+		{"rgb", TYPE_IMG_RGB, w, rgb},
+	}
+}
+
+// SHA-256 esperado de cada entrada por nível. Mudam quando o formato ou as
+// escolhas do codificador mudam de propósito; nunca por plataforma ou
+// GOMAXPROCS.
+var reproGolden = map[string]string{
+	"texto/1":           "a497db7ba35f5f0de95d53d84e25103f6abb957f0b974488c6163405819ca4c1",
+	"texto/6":           "e61d698b9ba0277c034764b8ad8ea2355d1e414ba36817d60ae13fece22c17e5",
+	"texto/9":           "c9ab35abbd612020a9c90ad600e75bc351f136701e96da435ca11183fc5eabc2",
+	"binario/1":         "056cf773d2994af73c218e75afcbb1d610f1308e9ed814570411b63ff700bb2f",
+	"binario/6":         "c10485ef25946d62f47c766f5f77a3e21cac3add0c5606c8b853394d4d9c8f59",
+	"binario/9":         "5c2f4a949b2c41881db4a8edcb54f4a546102c9ee6a15cd8ce1f195916e336fc",
+	"rgb/1":             "332da8550e6be331f7d0ba6202a26d95f45df93ac5a02e14b58fa1aa23a6cb89",
+	"rgb/6":             "b7a2858e5db3e488336b2b2d74f12dc6cdfac1670f15f639007e133c1a0f4a00",
+	"rgb/9":             "b619272a3030e3af09b28830aedc54326d36fbe7e7e17e0bd9c83ad9d5eba6eb",
+	"encoder/texto/1":   "ee6a911b8daa7c742bda1127d941a9b5f09d64dd8d0f2d7e9a6f21d20ad57004",
+	"encoder/texto/6":   "5cfbd9f34adccbd1f23e93207f36f8f9a01e4180ed636bdf6219cc4aeaead582",
+	"encoder/texto/9":   "4bd18bc71d95e76e08ae813e9ae252082c020229a4ed3413070d2b496b21f3dd",
+	"encoder/binario/1": "572bc15c342449158af445a075bb5f6e0f3439f65da770ee34e42482f69e5fca",
+	"encoder/binario/6": "bf0d4fe508acbd049b02cd8edc99ee672e48511620ca9dc211f05b96b037269b",
+	"encoder/binario/9": "71705406349975295857acd127ee602d112a3df9afc46e7e3e33dd989e6de4fa",
+	"encoder/rgb/1":     "a90c1cd8b0cd7fef15a812c445aa3844a7577dcac2f98c7cc3697f30b3c6ba97",
+	"encoder/rgb/6":     "001b429e18e6f8616be3a041b3a37fe7b8634d38525c19375a17b24d82f3bc80",
+	"encoder/rgb/9":     "95eb35647b1b1cbd191c9618d4271bdfee713bd7114bd10820c60d05a6c2619f",
+}
+
+func TestReproducibleOutput(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(procs)
+
+	for _, in := range reproInputs() {
+		for _, level := range []int{1, 6, 9} {
+			key := fmt.Sprintf("%s/%d", in.name, level)
+			opts := DefaultOptions()
+			opts.Level = level
+
+			var first []byte
+			for _, n := range []int{1, 2, 7, 16} {
+				runtime.GOMAXPROCS(n)
+				var out bytes.Buffer
+				if err := ViktorCompressWithOptions(in.data, in.dataType, in.width, opts, &out); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				if first == nil {
+					first = out.Bytes()
+				} else if !bytes.Equal(out.Bytes(), first) {
+					t.Errorf("%s: GOMAXPROCS=%d gerou outra saída", key, n)
+				}
+			}
+			runtime.GOMAXPROCS(procs)
+
+			if got := fmt.Sprintf("%x", sha256.Sum256(first)); got != reproGolden[key] {
+				t.Errorf("%s: sha256 %s, esperado %s", key, got, reproGolden[key])
+			}
+
+			restored, err := ViktorDecompress(bytes.NewReader(first))
+			if err != nil || !bytes.Equal(restored, in.data) {
+				t.Errorf("%s: a descompressão não devolveu a entrada (%v)", key, err)
+			}
+		}
+	}
+}
+
+// Um Encoder reaproveitado depois de outra entrada produz o mesmo que um novo
+func TestReusedEncoderOutput(t *testing.T) {
+	for _, in := range reproInputs() {
+		isImage := in.width > 0
+		for _, level := range []int{1, 6, 9} {
+			var fresh, reused bytes.Buffer
+			enc := NewEncoder(&fresh)
+			enc.SetLevel(level)
+			if err := enc.Encode(in.data, isImage); err != nil {
+				t.Fatal(err)
+			}
+
+			rotated := append(append([]byte{}, in.data[len(in.data)/2:]...), in.data[:len(in.data)/2]...)
+			enc.Reset(&bytes.Buffer{})
+			enc.Encode(rotated, isImage)
+			enc.Reset(&reused)
+			if err := enc.Encode(in.data, isImage); err != nil {
+				t.Fatal(err)
+			}
+
+			key := fmt.Sprintf("encoder/%s/%d", in.name, level)
+			if !bytes.Equal(fresh.Bytes(), reused.Bytes()) {
+				t.Errorf("%s: o Encoder reaproveitado gerou outra saída", key)
+			}
+			if got := fmt.Sprintf("%x", sha256.Sum256(fresh.Bytes())); got != reproGolden[key] {
+				t.Errorf("%s: sha256 %s, esperado %s", key, got, reproGolden[key])
+			}
+		}
+	}
+}
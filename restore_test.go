@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreFile(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "log.txt")
+	data := reproInputs()[0].data
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	header := &Header{DataType: TYPE_TEXT, Meta: &FileMeta{
+		Name: "log.txt", Size: uint64(len(data)), ModTime: mtime, Mode: 0600,
+	}}
+
+	// Tamanho diferente do gravado no cabeçalho: erro e nada no diretório
+	if err := RestoreFile(data[1:], header, out, false); err == nil {
+		t.Fatal("tamanho errado aceito")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("sobrou %s depois do erro", entries[0].Name())
+	}
+
+	if err := RestoreFile(data, header, out, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("conteúdo restaurado difere: %v", err)
+	}
+	info, _ := os.Stat(out)
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("metadados: %v %v", info.Mode(), info.ModTime())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d arquivos no diretório, esperado só a saída", len(entries))
+	}
+
+	// Sem force não sobrescreve; com force troca o conteúdo
+	if err := RestoreFile(data, header, out, false); err == nil {
+		t.Fatal("sobrescreveu sem --force")
+	}
+	header.Meta.Size = 5
+	if err := RestoreFile(data[:5], header, out, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data[:5]) {
+		t.Fatal("--force não trocou o conteúdo")
+	}
+}
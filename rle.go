@@ -1,58 +1,319 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"fmt"
+	"io"
 )
 
-// Compress recebe dados brutos e retorna dados comprimidos em RLE
-func Compress(data []byte) []byte {
-	if len(data) == 0 {
-		return []byte{}
+// RLE no estilo PackBits (TIFF), em unidades de `unit` bytes (1 no
+// FLAG_RLE, uma linha da imagem no pré-passo). Cada pacote começa com um
+// byte de controle n:
+//
+//	0..127:   n+1 unidades literais em seguida
+//	129..255: a próxima unidade repetida 257-n vezes (2 a 128)
+//	128:      fim do stream
+//
+// Um literal de 128 unidades custa 1 byte a mais, então dados sem repetição
+// crescem no máximo 1/128 (mais o byte de fim). A marca de fim deixa o
+// stream delimitado sem tamanho na frente, como o EOF dos streams Huffman.
+const (
+	rleMaxRun = 128
+	rleEnd    = 128
+	// Repetições mais curtas que isso ficam no literal em aberto: um par
+	// custaria o mesmo byte de controle que se economiza
+	rleMinRun = 3
+)
+
+// Pré-passo de imagens de 8 bits (ImageParams.Prepass). O PREPASS_RLE é o
+// PackBits com uma linha da imagem por unidade, antes da transformada e do
+// filtro 2D: sequências de linhas iguais (fundo de telas e desenhos) viram
+// uma linha só, e o que sobra continua sendo uma grade de mesma largura, que
+// passa pelo pipeline normal. Com unidade de um pixel a saída não seria mais
+// uma grade e o filtro não teria vizinho de cima.
+//
+//	[bytes u32][bytes de controle do PackBits][streams da grade reduzida]
+//
+// As linhas mantidas ficam na grade, na ordem dos pacotes; o controle diz
+// quantas são literais e quantas vezes cada repetida se expande.
+const (
+	PREPASS_NONE = 0
+	PREPASS_RLE  = 1
+
+	// Não é gravado: usa o RLE quando linhas repetidas são comuns
+	PREPASS_AUTO = 0xFF
+
+	// Fração mínima (em 1/256) de linhas iguais à de cima para o
+	// PREPASS_AUTO escolher o RLE
+	rlePrepassMinRepeated = 16
+)
+
+// Codifica o que recebe em pacotes PackBits à medida que chega. As últimas
+// rleMaxRun unidades esperam mais dados (uma repetição que começa nelas ainda
+// pode crescer), então a saída não depende de como a entrada foi dividida
+// entre os Writes.
+type RLEWriter struct {
+	w       io.Writer
+	unit    int
+	pending []byte // Literal em aberto + unidades ainda não codificadas
+	lit     int    // Unidades do literal em aberto no começo de pending
+	out     []byte
+	err     error
+	closed  bool
+}
+
+func NewRLEWriter(w io.Writer, unit int) *RLEWriter {
+	return &RLEWriter{w: w, unit: max(unit, 1)}
+}
+
+func (rw *RLEWriter) Write(p []byte) (int, error) {
+	if rw.closed {
+		return 0, fmt.Errorf("stream RLE já fechado")
+	}
+	if rw.err != nil {
+		return 0, rw.err
 	}
+	rw.pending = append(rw.pending, p...)
+	rw.encode(false)
+	return len(p), rw.err
+}
 
-	var buffer bytes.Buffer
-	// Olha para frente para ver se o próximo byte é igual ao atual
-	// limitar count a 255 porque precisa que caiba em 1 único Byte (uint8)
-	for i := 0; i < len(data); {
-		count := 1
-		for i+count < len(data) && data[i] == data[i+count] && count < 255 {
-			count++
+// Grava o resto e a marca de fim. Não fecha o io.Writer de baixo.
+func (rw *RLEWriter) Close() error {
+	if rw.closed {
+		return rw.err
+	}
+	rw.closed = true
+	if rw.err != nil {
+		return rw.err
+	}
+	if len(rw.pending)%rw.unit != 0 {
+		return fmt.Errorf("RLE: %d bytes não formam unidades de %d", len(rw.pending), rw.unit)
+	}
+	rw.encode(true)
+	if rw.err == nil {
+		_, rw.err = rw.w.Write([]byte{rleEnd})
+	}
+	return rw.err
+}
+
+func (rw *RLEWriter) encode(final bool) {
+	u := rw.unit
+	units := len(rw.pending) / u
+	start, i := 0, rw.lit // O literal em aberto vai de start até i
+	for i < units && (final || units-i > rleMaxRun) {
+		unit := rw.pending[i*u : (i+1)*u]
+		run := 1
+		for run < rleMaxRun && i+run < units && bytes.Equal(unit, rw.pending[(i+run)*u:(i+run+1)*u]) {
+			run++
+		}
+
+		if run >= rleMinRun || (run == 2 && i == start) {
+			rw.flushLiteral(start, i)
+			rw.out = append(rw.out, byte(257-run))
+			rw.out = append(rw.out, unit...)
+			i += run
+			start = i
+			continue
 		}
+		i++
+		if i-start == rleMaxRun {
+			rw.flushLiteral(start, i)
+			start = i
+		}
+	}
 
-		// Escreve primeiro a quantidade (Contagem)
-		buffer.WriteByte(byte(count))
-		// Escreve qual é o caractere (O Byte)
-		buffer.WriteByte(data[i])
+	if final {
+		rw.flushLiteral(start, i)
+		start = i
+	}
+	rw.lit = i - start
+	rw.pending = rw.pending[:copy(rw.pending, rw.pending[start*u:])]
+	if len(rw.out) > 0 {
+		_, rw.err = rw.w.Write(rw.out)
+		rw.out = rw.out[:0]
+	}
+}
 
-		// Pula o índice para o próximo bloco de caracteres novos
-		i += count
+func (rw *RLEWriter) flushLiteral(start, end int) {
+	if end > start {
+		rw.out = append(rw.out, byte(end-start-1))
+		rw.out = append(rw.out, rw.pending[start*rw.unit:end*rw.unit]...)
 	}
+}
 
-	return buffer.Bytes()
+// Decodifica um stream PackBits aos poucos, até a marca de fim. Lê adiantado
+// do reader de baixo, como o bitio.Reader.
+type RLEReader struct {
+	r    *bufio.Reader
+	unit int
+	buf  []byte // Último pacote decodificado
+	off  int    // Início dos bytes de buf ainda não devolvidos
+	done bool
+	err  error
 }
 
-// Decompress faz o inverso: lê [count][char] e expande
-func Decompress(data []byte) ([]byte, error) {
-	var buffer bytes.Buffer
+func NewRLEReader(r io.Reader, unit int) *RLEReader {
+	return &RLEReader{r: bufio.NewReader(r), unit: max(unit, 1)}
+}
 
-	// Precisa ler de 2 em 2 bytes (par: contagem + valor)
-	for i := 0; i < len(data); i += 2 {
-		// Proteção para não ler fora do array se o arquivo estiver corrompido
-		if i+1 >= len(data) {
-			return nil, errors.New("Arquivo comprimido ou incompleto")
+func (rr *RLEReader) Read(p []byte) (int, error) {
+	for rr.off == len(rr.buf) && !rr.done && rr.err == nil {
+		rr.next()
+	}
+
+	n := copy(p, rr.buf[rr.off:])
+	rr.off += n
+	if n > 0 {
+		return n, nil
+	}
+	if rr.err != nil {
+		if rr.err == io.EOF || rr.err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("stream RLE truncado")
 		}
+		return 0, rr.err
+	}
+	return 0, io.EOF
+}
 
-		// Quantas vezes repetir
-		count := int(data[i])
-		// Qual valor repetir
-		val := data[i+1]
+func (rr *RLEReader) next() {
+	rr.buf, rr.off = rr.buf[:0], 0
+	n, err := rr.r.ReadByte()
+	if err != nil {
+		rr.err = err
+		return
+	}
 
-		// Escreve o valor 'count' vezes
-		for j := 0; j < count; j++ {
-			buffer.WriteByte(val)
+	switch {
+	case n == rleEnd:
+		rr.done = true
+	case n < rleEnd:
+		size := (int(n) + 1) * rr.unit
+		if cap(rr.buf) < size {
+			rr.buf = make([]byte, size)
+		}
+		rr.buf = rr.buf[:size]
+		_, rr.err = io.ReadFull(rr.r, rr.buf)
+	default:
+		unit := make([]byte, rr.unit)
+		if _, rr.err = io.ReadFull(rr.r, unit); rr.err != nil {
+			return
+		}
+		for range 257 - int(n) {
+			rr.buf = append(rr.buf, unit...)
 		}
 	}
+}
 
+// RLECompress devolve data em PackBits, com a marca de fim. len(data) tem
+// que ser múltiplo de unit.
+func RLECompress(data []byte, unit int) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + len(data)/rleMaxRun + 2)
+	rw := NewRLEWriter(&buffer, unit)
+	rw.Write(data)
+	if err := rw.Close(); err != nil {
+		return nil, err
+	}
 	return buffer.Bytes(), nil
 }
+
+// RLEDecompress faz o inverso, até a marca de fim
+func RLEDecompress(data []byte, unit int) ([]byte, error) {
+	return io.ReadAll(NewRLEReader(bytes.NewReader(data), unit))
+}
+
+// Backend de FLAG_RLE: o stream do payload vai direto em PackBits, sem LZ77
+// nem Huffman. Só compensa em dados com repetições longas, mas é rápido.
+func RLECompressStream(data []byte, output io.Writer, isImage bool) error {
+	packed, err := RLECompress(data, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[Compress] RLE: %d -> %d bytes\n", len(data), len(packed))
+	_, err = output.Write(packed)
+	return err
+}
+
+// Como o HuffmanDecompressPrefix: para depois de `limit` bytes (limit < 0
+// decodifica até a marca de fim)
+func RLEDecompressPrefix(r io.Reader, limit int) ([]byte, error) {
+	var src io.Reader = NewRLEReader(r, 1)
+	if limit >= 0 {
+		src = io.LimitReader(src, int64(limit))
+	}
+	result, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[Decompress] Sucesso! Total: %d bytes\n", len(result))
+	return result, nil
+}
+
+// Separa o PackBits das linhas nos bytes de controle e nas linhas mantidas
+func rlePackRows(data []byte, rowSize int) (controls, rows []byte, err error) {
+	packed, err := RLECompress(data, rowSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(packed) > 0 {
+		c := packed[0]
+		controls = append(controls, c)
+		n := rowSize
+		switch {
+		case c == rleEnd:
+			return controls, rows, nil
+		case c < rleEnd:
+			n = (int(c) + 1) * rowSize
+		}
+		rows = append(rows, packed[1:1+n]...)
+		packed = packed[1+n:]
+	}
+	return nil, nil, fmt.Errorf("pré-passo RLE sem marca de fim")
+}
+
+// O inverso do rlePackRows
+func rleUnpackRows(controls, rows []byte, rowSize int) ([]byte, error) {
+	var out []byte
+	for _, c := range controls {
+		n, repeat := 1, 1
+		switch {
+		case c == rleEnd:
+			if len(rows) != 0 {
+				return nil, fmt.Errorf("pré-passo RLE: %d bytes de linhas sobrando", len(rows))
+			}
+			return out, nil
+		case c < rleEnd:
+			n = int(c) + 1
+		default:
+			repeat = 257 - int(c)
+		}
+		if n*rowSize > len(rows) {
+			return nil, fmt.Errorf("pré-passo RLE: faltam linhas")
+		}
+		for range repeat {
+			out = append(out, rows[:n*rowSize]...)
+		}
+		rows = rows[n*rowSize:]
+	}
+	return nil, fmt.Errorf("pré-passo RLE sem marca de fim")
+}
+
+func chooseRLEPrepass(data []byte, width int, kind *PayloadKind) uint8 {
+	rowSize := width * kind.PixelSize()
+	rows := len(data) / max(rowSize, 1)
+	if rows < 2 {
+		return PREPASS_NONE
+	}
+	repeated := 0
+	for y := 1; y < rows; y++ {
+		if bytes.Equal(data[y*rowSize:(y+1)*rowSize], data[(y-1)*rowSize:y*rowSize]) {
+			repeated++
+		}
+	}
+	if repeated*256 < (rows-1)*rlePrepassMinRepeated {
+		return PREPASS_NONE
+	}
+	return PREPASS_RLE
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Imagem com faixas de linhas repetidas entre linhas de ruído
+func rleTestImage(width, height int) []byte {
+	data := make([]byte, width*height*3)
+	seed := uint32(7)
+	for y := range height {
+		row := data[y*width*3 : (y+1)*width*3]
+		if y%40 >= 10 && y > 0 {
+			copy(row, data[(y-1)*width*3:y*width*3])
+			continue
+		}
+		for i := range row {
+			seed = seed*1664525 + 1013904223
+			row[i] = byte(seed >> 24)
+		}
+	}
+	return data
+}
+
+func TestRLEPrepassRoundTrip(t *testing.T) {
+	const width, height = 300, 200
+	data := rleTestImage(width, height)
+
+	for _, near := range []uint8{0, 3} {
+		opts := DefaultOptions()
+		opts.Prepass = PREPASS_AUTO
+		opts.Near = near
+		var buf bytes.Buffer
+		if err := ViktorCompressWithOptions(data, TYPE_IMG_RGB, width, opts, &buf); err != nil {
+			t.Fatal(err)
+		}
+		restored, header, err := ViktorDecompressWithHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Image == nil || header.Image.Prepass != PREPASS_RLE {
+			t.Fatalf("near %d: PREPASS_AUTO não escolheu o RLE", near)
+		}
+		if len(restored) != len(data) {
+			t.Fatalf("near %d: %d bytes, esperava %d", near, len(restored), len(data))
+		}
+		for i := range data {
+			if d := int(restored[i]) - int(data[i]); d > int(near) || d < -int(near) {
+				t.Fatalf("near %d: byte %d com erro %d", near, i, d)
+			}
+		}
+	}
+}
+
+func TestRLEPackRows(t *testing.T) {
+	const rowSize = 12
+	data := rleTestImage(4, 100)
+	controls, rows, err := rlePackRows(data, rowSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) >= len(data) {
+		t.Fatalf("%d bytes de linhas, sem redução", len(rows))
+	}
+	restored, err := rleUnpackRows(controls, rows, rowSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, data) {
+		t.Fatal("linhas diferentes depois do pré-passo")
+	}
+	if _, err := rleUnpackRows(controls, rows[:len(rows)-rowSize], rowSize); err == nil {
+		t.Fatal("linhas faltando aceitas")
+	}
+	if _, err := rleUnpackRows(controls[:len(controls)-1], rows, rowSize); err == nil {
+		t.Fatal("controle sem marca de fim aceito")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"yoursync/bitio"
+)
+
+// Comprime um fluxo de tamanho desconhecido numa passada só, com Huffman
+// adaptativo (adaptive.go). O resultado é um .ys comum com FLAG_ADAPTIVE:
+// ViktorDecompress lê o arquivo inteiro e o AdaptiveReader decodifica aos
+// poucos. Flush grava tudo que já foi escrito de modo que o outro lado
+// consiga decodificar sem esperar mais dados, como o Z_SYNC_FLUSH do zlib.
+type StreamWriter struct {
+	bw       *bitio.Writer
+	coder    *adaptiveCoder
+	matcher  lz77Matcher
+	finder   matchFinder
+	settings matchSettings
+	minMatch int
+	data     []byte // Janela do LZ77 + bytes ainda não codificados
+	pos      int    // Próxima posição de data a codificar
+	symbols  []LZ77Symbol
+	closed   bool
+}
+
+// Só tipos sem pré-processamento e com um stream (texto, CSV, binário...):
+// os outros precisam do buffer inteiro antes de comprimir
+func NewStreamWriter(w io.Writer, dataType uint8, level int) (*StreamWriter, error) {
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		return nil, err
+	}
+	if kind.IsImage || kind.Preprocess != nil || kind.Planes > 1 {
+		return nil, fmt.Errorf("tipo %s não pode ser comprimido em stream", kind.Name)
+	}
+
+	header := &Header{DataType: dataType, Flags: FLAG_ADAPTIVE}
+	if err := WriteFileHeader(w, header); err != nil {
+		return nil, err
+	}
+
+	// A cadeia de hash do nível padrão não sabe continuar de onde parou; o
+	// buscador do nível 3 é o mais próximo em velocidade
+	settings := matchSettingsForLevel(level)
+	if settings.finder == MATCH_HASH_CHAIN {
+		settings = matchSettingsForLevel(3)
+	}
+
+	sw := &StreamWriter{
+		bw:       bitio.NewWriter(w),
+		coder:    newAdaptiveCoder(),
+		settings: settings,
+		minMatch: 3,
+	}
+	if settings.finder == MATCH_BT4 {
+		sw.finder = &bt4Finder{}
+	} else {
+		sw.finder = &multiHashFinder{}
+	}
+	sw.finder.reset(nil, settings)
+	return sw, nil
+}
+
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, fmt.Errorf("stream já fechado")
+	}
+	sw.data = append(sw.data, p...)
+	// Os últimos bytes esperam mais dados: um match que começa neles ainda
+	// pode crescer
+	if end := len(sw.data) - lz77MaxMatch; end > sw.pos {
+		sw.encode(end)
+	}
+	return len(p), sw.bw.Err()
+}
+
+// Codifica tudo que foi escrito e completa o byte. O decodificador consegue
+// devolver todos os bytes escritos até aqui.
+func (sw *StreamWriter) Flush() error {
+	if sw.closed {
+		return nil
+	}
+	sw.encode(len(sw.data))
+	if err := sw.coder.writeFlush(sw.bw); err != nil {
+		return err
+	}
+	return sw.bw.Flush()
+}
+
+// Grava o EOF. Não fecha o io.Writer de baixo.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.encode(len(sw.data))
+	sw.coder.writeSymbol(sw.bw, LZ77Symbol(256))
+	sw.closed = true
+	return sw.bw.Flush()
+}
+
+func (sw *StreamWriter) encode(end int) {
+	sw.finder.setData(sw.data)
+	sw.symbols, sw.pos = sw.matcher.parseRange(sw.data, sw.pos, end, sw.minMatch, sw.finder, sw.settings, sw.symbols[:0])
+	for _, s := range sw.symbols {
+		sw.coder.writeSymbol(sw.bw, s)
+	}
+	sw.slide()
+}
+
+// Descarta o que já saiu da janela. Os buscadores indexam por posição no
+// buffer, então depois de mover os dados eles recomeçam e a janela mantida
+// é inserida de novo.
+func (sw *StreamWriter) slide() {
+	if sw.pos < 4*lz77WindowSize {
+		return
+	}
+	drop := sw.pos - lz77WindowSize
+	sw.data = sw.data[:copy(sw.data, sw.data[drop:])]
+	sw.pos -= drop
+
+	sw.finder.reset(sw.data, sw.settings)
+	for i := range sw.pos {
+		sw.finder.skip(i)
+	}
+}
+
+// stream [-d] [-1..-9] [-o saida]: comprime a entrada padrão como texto,
+// dando flush a cada leitura, ou descomprime (-d) à medida que os dados
+// chegam. As mensagens vão para a saída de erro, já que a saída padrão é o
+// próprio stream.
+func execStream(flags cliFlags) {
+	var out io.Writer = os.Stdout
+	if flags.output != "" {
+		f, err := createOutputFile(flags.output, 0644, flags.force)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Erro:", err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var err error
+	if flags.decode {
+		err = streamDecompress(os.Stdin, out)
+	} else {
+		err = streamCompress(os.Stdin, out, flags.level)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erro no stream:", err)
+	}
+}
+
+func streamCompress(r io.Reader, w io.Writer, level int) error {
+	sw, err := NewStreamWriter(w, TYPE_TEXT, level)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if _, err := sw.Write(chunk[:n]); err != nil {
+				return err
+			}
+			if err := sw.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+func streamDecompress(r io.Reader, w io.Writer) error {
+	header, err := ReadFileHeader(r)
+	if err != nil {
+		return err
+	}
+	if header.Flags&FLAG_ADAPTIVE == 0 {
+		return fmt.Errorf("arquivo sem FLAG_ADAPTIVE: use o decompress")
+	}
+
+	ar := NewAdaptiveReader(r)
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := ar.Read(chunk)
+		if n > 0 {
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
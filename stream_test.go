@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Aceita limit bytes e depois falha
+type failingWriter struct {
+	limit int
+}
+
+var errWriterFull = errors.New("disco cheio")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errWriterFull
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestStreamCompressWriteError(t *testing.T) {
+	data := reproInputs()[0].data
+	var full bytes.Buffer
+	if err := streamCompress(bytes.NewReader(data), &full, LEVEL_DEFAULT); err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{0, 16, full.Len() / 2, full.Len() - 1} {
+		err := streamCompress(bytes.NewReader(data), &failingWriter{limit}, LEVEL_DEFAULT)
+		if !errors.Is(err, errWriterFull) {
+			t.Errorf("limite %d de %d: erro %v", limit, full.Len(), err)
+		}
+	}
+}
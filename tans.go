@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"yoursync/bitio"
+)
+
+// tANS (table-based ANS, no estilo do FSE do zstd) sobre o mesmo alfabeto
+// de símbolos LZ77 do Huffman. As probabilidades são quantizadas numa tabela
+// de 2^log estados, o que permite gastar frações de bit por símbolo: um
+// símbolo com 95% dos casos custa ~0.07 bit em vez do 1 bit mínimo do
+// Huffman.
+//
+// O codificador processa os símbolos de trás para frente; os bits de cada
+// passo são guardados e gravados na ordem em que o decodificador vai pedi-los,
+// intercalados com os bits extras do LZ77.
+const (
+	tansAlphabet = lz77Alphabet
+	tansMaxLog   = 11
+	tansMinLog   = 5
+)
+
+type tansTable struct {
+	log    uint8
+	norm   []int    // Frequências normalizadas, somam 1<<log
+	spread []uint16 // Símbolo de cada estado
+}
+
+// Escolhe o tamanho da tabela e normaliza as frequências para somar 1<<log.
+// Todo símbolo presente fica com pelo menos 1.
+func newTANSTable(freqs []int) *tansTable {
+	total, distinct := 0, 0
+	for _, f := range freqs {
+		total += f
+		if f > 0 {
+			distinct++
+		}
+	}
+
+	log := uint8(tansMaxLog)
+	for log > tansMinLog && 1<<(log-1) >= max(total, 2*distinct) {
+		log--
+	}
+	size := 1 << log
+
+	norm := make([]int, tansAlphabet)
+	sum, largest := 0, -1
+	for s, f := range freqs {
+		if f == 0 {
+			continue
+		}
+		norm[s] = max((f*size+total/2)/total, 1)
+		sum += norm[s]
+		if largest < 0 || norm[s] > norm[largest] {
+			largest = s
+		}
+	}
+
+	// Arredondamentos para cima (símbolos raros forçados a 1) podem passar
+	// do total; tira dos maiores
+	for sum > size {
+		biggest := largest
+		for s, n := range norm {
+			if n > norm[biggest] {
+				biggest = s
+			}
+		}
+		norm[biggest]--
+		sum--
+	}
+	norm[largest] += size - sum
+
+	return buildTANSTable(log, norm)
+}
+
+func buildTANSTable(log uint8, norm []int) *tansTable {
+	size := 1 << log
+	t := &tansTable{log: log, norm: norm, spread: make([]uint16, size)}
+
+	// Espalhamento do FSE: passo ímpar, então percorre todos os estados
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for range n {
+			t.spread[pos] = uint16(s)
+			pos = (pos + step) & (size - 1)
+		}
+	}
+	return t
+}
+
+// [log 4 bits][mapa de presença, 1 bit por símbolo do alfabeto] e, por
+// símbolo presente, freq-1 em Exp-Golomb: frequências pequenas (a maioria)
+// custam poucos bits
+func (t *tansTable) write(bw *bitio.Writer) {
+	bw.WriteBits(uint64(t.log), 4)
+	for _, n := range t.norm {
+		bw.WriteBits(uint64(min(n, 1)), 1)
+	}
+	for _, n := range t.norm {
+		if n > 0 {
+			writeExpGolomb(bw, uint64(n-1))
+		}
+	}
+}
+
+func readTANSTable(br *bitio.Reader) (*tansTable, error) {
+	log, err := br.ReadBits(4)
+	if err != nil {
+		return nil, err
+	}
+	if log < tansMinLog || log > tansMaxLog {
+		return nil, fmt.Errorf("tabela tANS com log %d inválido", log)
+	}
+
+	norm := make([]int, tansAlphabet)
+	for s := range norm {
+		present, err := br.ReadBits(1)
+		if err != nil {
+			return nil, err
+		}
+		norm[s] = int(present)
+	}
+
+	sum := 0
+	for s, present := range norm {
+		if present == 0 {
+			continue
+		}
+		v, err := readExpGolomb(br)
+		if err != nil {
+			return nil, err
+		}
+		if v >= 1<<log {
+			return nil, fmt.Errorf("frequência tANS %d fora da tabela", v+1)
+		}
+		norm[s] = int(v) + 1
+		sum += norm[s]
+	}
+	if sum != 1<<log {
+		return nil, fmt.Errorf("frequências tANS somam %d, esperado %d", sum, 1<<log)
+	}
+	return buildTANSTable(uint8(log), norm), nil
+}
+
+// Exp-Golomb de ordem 0: (bits(v+1)-1) zeros seguidos de v+1 em binário
+func writeExpGolomb(bw *bitio.Writer, v uint64) {
+	n := uint8(bits.Len64(v + 1))
+	bw.WriteBits(0, n-1)
+	bw.WriteBits(v+1, n)
+}
+
+func readExpGolomb(br *bitio.Reader) (uint64, error) {
+	zeros := uint8(0)
+	for {
+		bit, err := br.ReadBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 32 {
+			return 0, fmt.Errorf("código Exp-Golomb inválido")
+		}
+	}
+	rest, err := br.ReadBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<zeros | rest) - 1, nil
+}
+
+func encodeTANSBlock(symbols []LZ77Symbol) []byte {
+	freqs := make([]int, tansAlphabet)
+	for _, s := range symbols {
+		freqs[s.Code()]++
+	}
+	t := newTANSTable(freqs)
+	size := 1 << t.log
+
+	// Estado do codificador (em [size, 2*size)) para cada par (símbolo, x),
+	// com x em [norm, 2*norm)
+	start := make([]int, tansAlphabet)
+	acc := 0
+	for s, n := range t.norm {
+		start[s] = acc
+		acc += n
+	}
+	next := append([]int(nil), t.norm...)
+	states := make([]int, size)
+	for u, s := range t.spread {
+		states[start[s]+next[s]-t.norm[s]] = size + u
+		next[s]++
+	}
+
+	type chunk struct {
+		val   uint64
+		nbits uint8
+	}
+	chunks := make([]chunk, len(symbols))
+	x := size
+	for i := len(symbols) - 1; i >= 0; i-- {
+		s := symbols[i].Code()
+		n := t.norm[s]
+		nb := uint8(0)
+		for x>>nb >= 2*n {
+			nb++
+		}
+		chunks[i] = chunk{uint64(x & (1<<nb - 1)), nb}
+		x = states[start[s]+x>>nb-n]
+	}
+
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	t.write(bw)
+	bw.WriteBits(uint64(x-size), t.log)
+	for i, c := range chunks {
+		bw.WriteBits(c.val, c.nbits)
+		if symbols[i].ExtraBits() > 0 {
+			bw.WriteBits(uint64(symbols[i].ExtraVal()), uint8(symbols[i].ExtraBits()))
+		}
+	}
+	bw.Flush()
+	return buf.Bytes()
+}
+
+func decodeTANSBlock(payload []byte, count int) ([]LZ77Symbol, error) {
+	br := bitio.NewReader(bytes.NewReader(payload))
+	t, err := readTANSTable(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tabela de decodificação: para cada estado, quantos bits ler e a base
+	// do próximo estado
+	size := 1 << t.log
+	next := append([]int(nil), t.norm...)
+	nbits := make([]uint8, size)
+	base := make([]int, size)
+	for u, s := range t.spread {
+		x := next[s]
+		next[s]++
+		nbits[u] = t.log - uint8(bits.Len(uint(x))-1)
+		base[u] = x<<nbits[u] - size
+	}
+
+	state, err := br.ReadBits(t.log)
+	if err != nil {
+		return nil, err
+	}
+
+	symbols := make([]LZ77Symbol, count)
+	for i := range symbols {
+		code := int(t.spread[state])
+		v, err := br.ReadBits(nbits[state])
+		if err != nil {
+			return nil, fmt.Errorf("bloco tANS truncado: %w", err)
+		}
+		state = uint64(base[state]) + v
+
+		symbols[i], err = readExtraBits(br, code)
+		if err != nil {
+			return nil, fmt.Errorf("bloco tANS truncado: %w", err)
+		}
+	}
+	return symbols, nil
+}
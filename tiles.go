@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Imagens grandes divididas em tiles (FLAG_TILES). Cada tile de lado
+// TileSize (os da borda direita/inferior podem ser menores) passa pelo
+// pipeline inteiro como uma imagem própria: filtro, transformada e árvores
+// começam do zero, então qualquer tile pode ser decodificado sozinho.
+//
+//	[altura u32][bytes u32 por tile, em ordem de linha][payloads dos tiles]
+const (
+	TILE_SIZE_DEFAULT = 256
+
+	// Abaixo disso o custo de uma árvore por tile não compensa
+	tileMinPixels = 2048 * 2048
+)
+
+type tileGrid struct {
+	width, height, size int
+	cols, rows          int
+}
+
+func newTileGrid(width, height, size int) tileGrid {
+	return tileGrid{
+		width: width, height: height, size: size,
+		cols: (width + size - 1) / size,
+		rows: (height + size - 1) / size,
+	}
+}
+
+func (g tileGrid) count() int {
+	return g.cols * g.rows
+}
+
+func (g tileGrid) rect(i int) image.Rectangle {
+	x, y := (i%g.cols)*g.size, (i/g.cols)*g.size
+	return image.Rect(x, y, min(x+g.size, g.width), min(y+g.size, g.height))
+}
+
+// Cabeçalho que o pipeline vê para um tile: mesmos parâmetros, largura do tile
+func tileHeader(header *Header, rect image.Rectangle) *Header {
+	th := *header
+	th.Width = rect.Dx()
+	th.TileSize = 0
+	return &th
+}
+
+// Copia o retângulo rect de uma imagem crua de largura width
+func cropRaw(data []byte, width, pixel int, rect image.Rectangle) []byte {
+	rowSize := rect.Dx() * pixel
+	out := make([]byte, 0, rowSize*rect.Dy())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		start := (y*width + rect.Min.X) * pixel
+		out = append(out, data[start:start+rowSize]...)
+	}
+	return out
+}
+
+// Inverso do cropRaw: grava src (do tamanho de rect) dentro de dst
+func pasteRaw(dst []byte, width, pixel int, rect image.Rectangle, src []byte) {
+	rowSize := rect.Dx() * pixel
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		start := (y*width + rect.Min.X) * pixel
+		copy(dst[start:start+rowSize], src[(y-rect.Min.Y)*rowSize:])
+	}
+}
+
+func compressTiles(data []byte, kind *PayloadKind, header *Header, opts Options, output io.Writer) error {
+	pixel := kind.PixelSize()
+	height := len(data) / (header.Width * pixel)
+	grid := newTileGrid(header.Width, height, header.TileSize)
+	fmt.Printf("Dividindo em %d tiles de %dpx...\n", grid.count(), grid.size)
+
+	// Os tiles são independentes, então dá para comprimir em paralelo
+	payloads := make([][]byte, grid.count())
+	errs := make([]error, grid.count())
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	for i := range payloads {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rect := grid.rect(i)
+			var buf bytes.Buffer
+			errs[i] = compressPayload(cropRaw(data, header.Width, pixel, rect), kind, tileHeader(header, rect), opts, &buf)
+			payloads[i] = buf.Bytes()
+		}(i)
+	}
+	wg.Wait()
+
+	index := binary.LittleEndian.AppendUint32(nil, uint32(height))
+	for i, p := range payloads {
+		if errs[i] != nil {
+			return fmt.Errorf("tile %d: %w", i, errs[i])
+		}
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(p)))
+	}
+	if _, err := output.Write(index); err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		if _, err := output.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTileIndex(r io.Reader, kind *PayloadKind, header *Header) (tileGrid, []int64, error) {
+	var height uint32
+	if err := binary.Read(r, binary.LittleEndian, &height); err != nil {
+		return tileGrid{}, nil, fmt.Errorf("índice de tiles: %w", err)
+	}
+	if err := kind.checkImageSize(header.Width, int(height)); err != nil {
+		return tileGrid{}, nil, err
+	}
+	grid := newTileGrid(header.Width, int(height), header.TileSize)
+
+	raw, err := readSized(r, 4*int64(grid.count()))
+	if err != nil {
+		return tileGrid{}, nil, fmt.Errorf("índice de tiles: %w", err)
+	}
+	lengths := make([]int64, grid.count())
+	for i := range lengths {
+		lengths[i] = int64(binary.LittleEndian.Uint32(raw[i*4:]))
+	}
+	return grid, lengths, nil
+}
+
+// Descompressão sequencial de todos os tiles (ViktorDecompress)
+func decompressTiles(r io.Reader, kind *PayloadKind, header *Header) ([]byte, error) {
+	grid, lengths, err := readTileIndex(r, kind, header)
+	if err != nil {
+		return nil, err
+	}
+
+	pixel := kind.PixelSize()
+	data := make([]byte, grid.width*grid.height*pixel)
+	for i, n := range lengths {
+		rect := grid.rect(i)
+		lr := io.LimitReader(r, n)
+		tile, err := decodeTile(lr, kind, header, rect)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		// O bitio.Reader pode não ter consumido o fim do stream
+		io.Copy(io.Discard, lr)
+		pasteRaw(data, grid.width, pixel, rect, tile)
+	}
+	return data, nil
+}
+
+func decodeTile(r io.Reader, kind *PayloadKind, header *Header, rect image.Rectangle) ([]byte, error) {
+	tile, err := decompressPayload(r, kind, tileHeader(header, rect))
+	if err != nil {
+		return nil, err
+	}
+	if want := rect.Dx() * rect.Dy() * kind.PixelSize(); len(tile) != want {
+		return nil, fmt.Errorf("tile com %d bytes, esperado %d", len(tile), want)
+	}
+	return tile, nil
+}
+
+// Acesso aleatório a uma imagem .ys: com tiles, só os tiles que cruzam a
+// região pedida são lidos e decodificados. Arquivos sem tiles são
+// decodificados inteiros na abertura.
+type TiledImage struct {
+	Header *Header
+	Kind   *PayloadKind
+	Height int
+
+	r       io.ReaderAt
+	grid    tileGrid
+	offsets []int64
+	lengths []int64
+	full    []byte
+}
+
+func OpenTiledImage(r io.ReaderAt, size int64) (*TiledImage, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	header, kind, err := readPayloadHeader(sr)
+	if err != nil {
+		return nil, err
+	}
+	if !kind.IsImage {
+		return nil, fmt.Errorf("o arquivo não contém dados de imagem")
+	}
+	t := &TiledImage{Header: header, Kind: kind, r: r}
+
+	if header.TileSize == 0 {
+		t.full, err = decompressPayload(sr, kind, header)
+		if err != nil {
+			return nil, err
+		}
+		t.Height = len(t.full) / (header.Width * kind.PixelSize())
+		return t, nil
+	}
+
+	t.grid, t.lengths, err = readTileIndex(sr, kind, header)
+	if err != nil {
+		return nil, err
+	}
+	t.Height = t.grid.height
+
+	pos, _ := sr.Seek(0, io.SeekCurrent)
+	t.offsets = make([]int64, len(t.lengths))
+	for i, n := range t.lengths {
+		t.offsets[i] = pos
+		pos += n
+	}
+	if pos > size {
+		return nil, fmt.Errorf("índice de tiles aponta além do fim do arquivo (%d > %d)", pos, size)
+	}
+	return t, nil
+}
+
+func (t *TiledImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, t.Header.Width, t.Height)
+}
+
+// Bytes crus (no layout do tipo) da região pedida, recortada aos limites da
+// imagem. Devolve também o retângulo efetivo.
+func (t *TiledImage) RegionBytes(rect image.Rectangle) ([]byte, image.Rectangle, error) {
+	rect = rect.Intersect(t.Bounds())
+	if rect.Empty() {
+		return nil, rect, fmt.Errorf("região fora da imagem")
+	}
+
+	pixel := t.Kind.PixelSize()
+	if t.full != nil {
+		return cropRaw(t.full, t.Header.Width, pixel, rect), rect, nil
+	}
+
+	out := make([]byte, rect.Dx()*rect.Dy()*pixel)
+	g := t.grid
+	for ty := rect.Min.Y / g.size; ty <= (rect.Max.Y-1)/g.size; ty++ {
+		for tx := rect.Min.X / g.size; tx <= (rect.Max.X-1)/g.size; tx++ {
+			i := ty*g.cols + tx
+			tileRect := g.rect(i)
+			tile, err := decodeTile(io.NewSectionReader(t.r, t.offsets[i], t.lengths[i]), t.Kind, t.Header, tileRect)
+			if err != nil {
+				return nil, rect, fmt.Errorf("tile %d: %w", i, err)
+			}
+
+			part := tileRect.Intersect(rect)
+			src := cropRaw(tile, tileRect.Dx(), pixel, part.Sub(tileRect.Min))
+			pasteRaw(out, rect.Dx(), pixel, part.Sub(rect.Min), src)
+		}
+	}
+	return out, rect, nil
+}
+
+// Decodifica só a região pedida. A imagem devolvida começa em (0, 0).
+func (t *TiledImage) DecodeRegion(rect image.Rectangle) (image.Image, error) {
+	raw, rect, err := t.RegionBytes(rect)
+	if err != nil {
+		return nil, err
+	}
+	return t.Kind.ToImage(raw, rect.Dx()), nil
+}
+
+// Reduz a imagem por `factor` em cada eixo, com média de cada bloco
+// factor x factor (o último bloco de cada eixo pode ser menor)
+func downsampleImage(img image.Image, factor int) image.Image {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, (b.Dx()+factor-1)/factor, (b.Dy()+factor-1)/factor))
+
+	for oy := range out.Rect.Dy() {
+		for ox := range out.Rect.Dx() {
+			var r, g, bl, a, n uint64
+			for y := b.Min.Y + oy*factor; y < min(b.Min.Y+(oy+1)*factor, b.Max.Y); y++ {
+				for x := b.Min.X + ox*factor; x < min(b.Min.X+(ox+1)*factor, b.Max.X); x++ {
+					c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			out.SetNRGBA(ox, oy, color.NRGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return out
+}
+
+// Níveis de zoom de uma TiledImage, para o /tile do view: o nível z reduz a
+// imagem por 2^z e é cortado em tiles de TILE_SIZE_DEFAULT. O nível 0 sai
+// direto dos tiles do .ys. Os níveis com uma prévia do mesmo tamanho saem da
+// pirâmide (preview.go); os outros são montados com os 4 tiles do nível
+// abaixo e guardados, então cada tile de um nível grosso custa uma redução
+// de 2x, não a decodificação da região inteira na resolução original.
+type TilePyramid struct {
+	Image *TiledImage
+
+	mu       sync.Mutex
+	tiles    map[tileKey]image.Image
+	previews map[int]image.Image // Prévias já decodificadas, por nível
+}
+
+type tileKey struct{ x, y, z int }
+
+func NewTilePyramid(t *TiledImage) *TilePyramid {
+	return &TilePyramid{Image: t, tiles: map[tileKey]image.Image{}, previews: map[int]image.Image{}}
+}
+
+// Nível em que a imagem inteira cabe num tile só
+func (p *TilePyramid) MaxZoom() int {
+	b := p.Image.Bounds()
+	z := 0
+	for max(b.Dx(), b.Dy()) > TILE_SIZE_DEFAULT<<z {
+		z++
+	}
+	return z
+}
+
+// Retângulo do nível z (em pixels desse nível) que a imagem ocupa
+func (p *TilePyramid) levelBounds(z int) image.Rectangle {
+	b := p.Image.Bounds()
+	return image.Rect(0, 0, (b.Dx()+1<<z-1)>>z, (b.Dy()+1<<z-1)>>z)
+}
+
+// Tile (x, y) do nível z. A imagem devolvida começa em (0, 0).
+func (p *TilePyramid) Tile(x, y, z int) (image.Image, error) {
+	if z < 0 || z > p.MaxZoom() {
+		return nil, fmt.Errorf("nível de zoom %d fora de 0..%d", z, p.MaxZoom())
+	}
+	rect := image.Rect(x*TILE_SIZE_DEFAULT, y*TILE_SIZE_DEFAULT, (x+1)*TILE_SIZE_DEFAULT, (y+1)*TILE_SIZE_DEFAULT)
+	if x < 0 || y < 0 || rect.Intersect(p.levelBounds(z)).Empty() {
+		return nil, fmt.Errorf("tile (%d, %d) fora do nível %d", x, y, z)
+	}
+	if z == 0 {
+		return p.Image.DecodeRegion(rect)
+	}
+
+	preview, err := p.preview(z)
+	if err != nil {
+		return nil, err
+	}
+	if preview != nil {
+		rect = rect.Intersect(preview.Bounds())
+		out := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		draw.Draw(out, out.Rect, preview, rect.Min, draw.Src)
+		return out, nil
+	}
+
+	key := tileKey{x, y, z}
+	p.mu.Lock()
+	tile, ok := p.tiles[key]
+	p.mu.Unlock()
+	if ok {
+		return tile, nil
+	}
+
+	rect = rect.Intersect(p.levelBounds(z))
+	out := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	half := TILE_SIZE_DEFAULT / 2
+	for dy := range 2 {
+		for dx := range 2 {
+			at := image.Pt(dx*half, dy*half)
+			if !at.In(out.Rect) {
+				continue
+			}
+			child, err := p.Tile(2*x+dx, 2*y+dy, z-1)
+			if err != nil {
+				return nil, err
+			}
+			small := downsampleImage(child, 2)
+			draw.Draw(out, small.Bounds().Add(at), small, image.Point{}, draw.Src)
+		}
+	}
+
+	p.mu.Lock()
+	p.tiles[key] = out
+	p.mu.Unlock()
+	return out, nil
+}
+
+// Prévia do .ys com o tamanho exato do nível z, decodificada uma vez; nil se
+// a pirâmide não tem esse nível
+func (p *TilePyramid) preview(z int) (image.Image, error) {
+	p.mu.Lock()
+	img, ok := p.previews[z]
+	p.mu.Unlock()
+	if ok {
+		return img, nil
+	}
+
+	bounds := p.levelBounds(z)
+	for i := range p.Image.Header.Previews {
+		pv := &p.Image.Header.Previews[i]
+		if pv.Width != bounds.Dx() || pv.Height != bounds.Dy() {
+			continue
+		}
+		decoded, err := pv.Decode()
+		if err != nil {
+			return nil, fmt.Errorf("prévia do nível %d: %w", z, err)
+		}
+		img = decoded
+		break
+	}
+
+	p.mu.Lock()
+	p.previews[z] = img
+	p.mu.Unlock()
+	return img, nil
+}
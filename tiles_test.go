@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"runtime"
+	"testing"
+)
+
+// Os tiles da pirâmide têm que bater com a imagem inteira reduzida: o nível
+// 1 é montado dos tiles do .ys e é exatamente a média 2x2; o último nível sai
+// da prévia gravada
+func TestTilePyramid(t *testing.T) {
+	const width, height = 2100, 2050 // Acima de tileMinPixels, bordas ímpares
+	data := make([]byte, width*height*3)
+	for i := range width * height {
+		x, y := i%width, i/width
+		data[3*i], data[3*i+1], data[3*i+2] = byte(x), byte(y), byte((x*y)>>6)
+	}
+
+	opts := DefaultOptions()
+	opts.Level = LEVEL_FASTEST
+	var buf bytes.Buffer
+	if err := ViktorCompressWithOptions(data, TYPE_IMG_RGB, width, opts, &buf); err != nil {
+		t.Fatal(err)
+	}
+	ti, err := OpenTiledImage(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Header.TileSize == 0 || len(ti.Header.Previews) == 0 {
+		t.Fatalf("esperava tiles e prévias (tiles %d, prévias %d)", ti.Header.TileSize, len(ti.Header.Previews))
+	}
+	p := NewTilePyramid(ti)
+	if p.MaxZoom() != 4 {
+		t.Fatalf("MaxZoom = %d, esperava 4", p.MaxZoom())
+	}
+
+	full := kindFor(t, TYPE_IMG_RGB).ToImage(data, width)
+	half := downsampleImage(full, 2)
+	for _, xy := range [][2]int{{0, 0}, {1, 2}, {4, 4}} {
+		tile, err := p.Tile(xy[0], xy[1], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := image.Rect(xy[0]*TILE_SIZE_DEFAULT, xy[1]*TILE_SIZE_DEFAULT, (xy[0]+1)*TILE_SIZE_DEFAULT, (xy[1]+1)*TILE_SIZE_DEFAULT).Intersect(half.Bounds())
+		if tile.Bounds().Size() != want.Size() {
+			t.Fatalf("tile %v: %v, esperava %v", xy, tile.Bounds(), want)
+		}
+		for y := range want.Dy() {
+			for x := range want.Dx() {
+				got := color.NRGBAModel.Convert(tile.At(x, y))
+				if exp := half.At(want.Min.X+x, want.Min.Y+y); got != exp {
+					t.Fatalf("tile %v, pixel (%d, %d): %v, esperava %v", xy, x, y, got, exp)
+				}
+			}
+		}
+	}
+
+	top, err := p.Tile(0, 0, p.MaxZoom())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := top.Bounds(); b.Dx() != (width+15)/16 || b.Dy() != (height+15)/16 {
+		t.Fatalf("nível %d: %v", p.MaxZoom(), b)
+	}
+
+	for _, bad := range [][3]int{{0, 0, 5}, {5, 0, 3}, {0, 9, 0}, {-1, 0, 1}} {
+		if _, err := p.Tile(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("tile %v aceito", bad)
+		}
+	}
+}
+
+func kindFor(t *testing.T, dataType uint8) *PayloadKind {
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kind
+}
+
+// Altura e tamanhos vêm de campos u32: um .ys corrompido de poucos bytes
+// tem que falhar sem alocar o que os campos pedem
+func TestCorruptImageSizes(t *testing.T) {
+	file := func(h *Header, fields ...uint32) []byte {
+		var buf bytes.Buffer
+		if err := WriteFileHeader(&buf, h); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range fields {
+			buf.Write(binary.LittleEndian.AppendUint32(nil, f))
+		}
+		return buf.Bytes()
+	}
+	context := &ImageParams{Filter: FILTER_ADAPTIVE, Entropy: ENTROPY_CONTEXT}
+	cases := map[string][]byte{
+		"contexto, altura": file(&Header{DataType: TYPE_IMG_RGB, Width: 1 << 16, Image: context}, 1<<31, 16),
+		"contexto, stream": file(&Header{DataType: TYPE_IMG_RGB, Width: 16, Image: context}, 16, 1<<31),
+		"tiles, altura":    file(&Header{DataType: TYPE_IMG_RGB, Width: 1 << 16, TileSize: 256}, 1<<31),
+		"tiles, índice":    file(&Header{DataType: TYPE_IMG_RGB, Width: 1 << 14, TileSize: 1}, 1<<14),
+		"pré-passo RLE":    file(&Header{DataType: TYPE_IMG_RGB, Width: 16, Image: &ImageParams{Prepass: PREPASS_RLE}}, 1<<31),
+	}
+	for name, data := range cases {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := ViktorDecompressWithHeader(bytes.NewReader(data))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: arquivo de %d bytes aceito", name, len(data))
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+			t.Errorf("%s: %d MiB alocados para um arquivo de %d bytes", name, alloc>>20, len(data))
+		}
+	}
+}
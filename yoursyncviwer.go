@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"html"
 	"image"
 	"image/png"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,25 +28,16 @@ func YoursyncToMemory(inputPath string) (image.Image, error) {
 		return nil, err
 	}
 
-	if dataType != TYPE_IMG {
-		return nil, fmt.Errorf("o arquivo não contém dados de imagem")
+	kind, err := LookupKind(dataType)
+	if err != nil {
+		return nil, err
 	}
-
-	// 3. Monta o objeto de imagem na RAM
-	height := len(restored) / (width * 3)
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	// Preenche os pixels (R, G, B, A)
-	idx := 0
-	for i := 0; i < len(img.Pix); i += 4 {
-		img.Pix[i] = restored[idx]     // R
-		img.Pix[i+1] = restored[idx+1] // G
-		img.Pix[i+2] = restored[idx+2] // B
-		img.Pix[i+3] = 255             // A
-		idx += 3
+	if !kind.IsImage {
+		return nil, fmt.Errorf("o arquivo não contém dados de imagem")
 	}
 
-	return img, nil
+	// 3. Monta o objeto de imagem na RAM no layout do tipo
+	return kind.ToImage(restored, width), nil
 }
 
 func showProgress(current, total int) {
@@ -78,11 +73,111 @@ func startYourSyncServer(ppPath string) {
 		// IMPORTANTE: ViktorDecompressAndGetMetadata deve ler o byte de tipo
 		// e os 4 bytes de largura antes do Huffman para não desalinharem.
 		restored, dataType, width, err := ViktorDecompressAndGetMetadata(file)
-		if err != nil || dataType != TYPE_IMG {
+		if err != nil {
+			return
+		}
+		kind, err := LookupKind(dataType)
+		if err != nil || !kind.IsImage {
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, kind.ToImage(restored, width))
+	})
+
+	// Prévia da pirâmide gravada no .ys (ou reduzida na hora, se não houver)
+	http.HandleFunc("/thumb", func(w http.ResponseWriter, r *http.Request) {
+		size := THUMBNAIL_SIZE_DEFAULT
+		if s := r.URL.Query().Get("size"); s != "" {
+			var err error
+			size, err = strconv.Atoi(s)
+			if err != nil || size <= 0 {
+				http.Error(w, "tamanho inválido", http.StatusBadRequest)
+				return
+			}
+		}
+
+		file, err := os.Open(ppPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		img, err := Thumbnail(file, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	})
+
+	// Tile (x, y) do nível de zoom z: z = 0 é a resolução original e cada
+	// nível acima reduz pela metade, até o nível em que a imagem cabe num
+	// tile só. A pirâmide fica aberta entre as requisições (arquivos sem
+	// tiles são decodificados uma vez) e é reaberta se o .ys mudar.
+	var pyramid struct {
+		sync.Mutex
+		file    *os.File
+		modTime time.Time
+		size    int64
+		p       *TilePyramid
+	}
+	openPyramid := func() (*TilePyramid, error) {
+		pyramid.Lock()
+		defer pyramid.Unlock()
+		info, err := os.Stat(ppPath)
+		if err != nil {
+			return nil, err
+		}
+		if pyramid.p != nil && info.ModTime().Equal(pyramid.modTime) && info.Size() == pyramid.size {
+			return pyramid.p, nil
+		}
+
+		file, err := os.Open(ppPath)
+		if err != nil {
+			return nil, err
+		}
+		ti, err := OpenTiledImage(file, info.Size())
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if pyramid.file != nil {
+			pyramid.file.Close()
+		}
+		pyramid.file, pyramid.modTime, pyramid.size = file, info.ModTime(), info.Size()
+		pyramid.p = NewTilePyramid(ti)
+		return pyramid.p, nil
+	}
+
+	http.HandleFunc("/tile", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		x, errX := strconv.Atoi(q.Get("x"))
+		y, errY := strconv.Atoi(q.Get("y"))
+		z, errZ := strconv.Atoi(q.Get("z"))
+		if errX != nil || errY != nil || errZ != nil || x < 0 || y < 0 || z < 0 {
+			http.Error(w, "parâmetros x, y e z inválidos", http.StatusBadRequest)
+			return
+		}
+
+		p, err := openPyramid()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if z > p.MaxZoom() {
+			http.Error(w, fmt.Sprintf("z vai de 0 a %d", p.MaxZoom()), http.StatusBadRequest)
+			return
+		}
+
+		img, err := p.Tile(x, y, z)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 
-		img := buildImageObject(restored, width)
 		w.Header().Set("Content-Type", "image/png")
 		png.Encode(w, img)
 	})
@@ -98,26 +193,55 @@ func startYourSyncServer(ppPath string) {
 		}
 		defer file.Close()
 
-		restoredData, dataType, _, err := ViktorDecompressAndGetMetadata(file)
-		duration := time.Since(start)
-
+		header, kind, err := readPayloadHeader(file)
 		if err != nil {
 			fmt.Fprintf(w, "Erro na descompressão: %v", err)
 			return
 		}
 
+		// Imagens não são decodificadas aqui: a página abre com a prévia e
+		// troca por resoluções maiores conforme elas chegam
+		var restoredData []byte
+		if !kind.IsImage {
+			restoredData, err = decompressBody(file, kind, header)
+			if err != nil {
+				fmt.Fprintf(w, "Erro na descompressão: %v", err)
+				return
+			}
+		}
+		duration := time.Since(start)
+		dataType := header.DataType
+
 		fileInfo, _ := os.Stat(ppPath)
 		sizeKB := fileInfo.Size() / 1024
 
+		quality := "sem perdas"
+		if header.Lossy() {
+			quality = fmt.Sprintf("com perdas (erro ≤ %d)", header.Image.Near)
+		}
+
 		var contentHTML string
-		if dataType == TYPE_IMG {
-			contentHTML = `<img src="/raw" />`
+		if kind.IsImage {
+			contentHTML = fmt.Sprintf(`
+                <img id="view" src="/thumb?size=%d" width="%d" />
+                <script>
+                    const full = new Image();
+                    full.onload = () => { document.getElementById("view").src = full.src; };
+                    full.src = "/raw";
+                </script>`, THUMBNAIL_SIZE_DEFAULT, header.Width)
+		} else if dataType == TYPE_BINARY {
+			// Binário não tem representação em texto: mostra um hex dump do início
+			preview := restoredData[:min(len(restoredData), 4096)]
+			contentHTML = fmt.Sprintf(`
+                <div class="text-container">
+                    <pre>%s</pre>
+                </div>`, html.EscapeString(hex.Dump(preview)))
 		} else {
-			// Tratamento para exibir texto/CSV com segurança
+			// Tratamento para exibir texto/CSV/JSON com segurança
 			contentHTML = fmt.Sprintf(`
                 <div class="text-container">
                     <pre>%s</pre>
-                </div>`, string(restoredData))
+                </div>`, html.EscapeString(string(restoredData)))
 		}
 
 		fmt.Fprintf(w, `
@@ -156,12 +280,13 @@ func startYourSyncServer(ppPath string) {
                         <p>📏 Tamanho: <span class="highlight">%d KB</span></p>
                         <p>⚡ Descompressão: <span class="highlight">%v</span></p>
                         <p>🏷️ Tipo: <span class="highlight">%s</span></p>
+                        <p>🎯 Qualidade: <span class="highlight">%s</span></p>
                     </div>
                     <br>
                     %s
                 </body>
             </html>
-        `, ppPath, sizeKB, duration, getTypeName(dataType), contentHTML)
+        `, ppPath, sizeKB, duration, getTypeName(dataType), quality, contentHTML)
 	})
 
 	fmt.Println("🚀 Dashboard YourSync em http://localhost:8080")
@@ -169,8 +294,9 @@ func startYourSyncServer(ppPath string) {
 }
 
 func getTypeName(t uint8) string {
-	if t == TYPE_IMG {
-		return "IMAGEM"
+	kind, err := LookupKind(t)
+	if err != nil {
+		return fmt.Sprintf("TIPO %d", t)
 	}
-	return "TEXTO"
+	return kind.Name
 }